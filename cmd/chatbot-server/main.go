@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/evalphobia/logrus_sentry"
 	"github.com/greatnonprofits-nfp/websocket-go/webchat"
 	"github.com/sirupsen/logrus"
@@ -17,12 +18,13 @@ func main() {
 	serverStartTime := time.Now()
 	config := server.LoadConfig("chatbot_server.toml")
 
+	if err := config.Validate(); err != nil {
+		logrus.Fatalf("Invalid configuration: %s", err)
+	}
+
 	// configure our logger
 	logrus.SetOutput(os.Stdout)
-	level, err := logrus.ParseLevel(config.LogLevel)
-	if err != nil {
-		logrus.Fatalf("Invalid log level '%s'", level)
-	}
+	level, _ := logrus.ParseLevel(config.LogLevel)
 	logrus.SetLevel(level)
 
 	// if we have a DSN entry, try to initialize it
@@ -38,24 +40,111 @@ func main() {
 		logrus.StandardLogger().Hooks.Add(hook)
 	}
 
-	// start hub to be able to receive msgs from courier
-	hub := webchat.NewHub()
-	go hub.Run()
+	// set up tracing before anything creates spans
+	shutdownTracing, err := server.InitTracing(config)
+	if err != nil {
+		logrus.Fatalf("Error initializing tracing: %s", err)
+	}
 
-	// run server with main routes
+	// create our server and start hub to be able to receive msgs from courier
 	s := server.NewServer(config)
+	hub := webchat.NewHubWithLogger(config, s.Logger())
+	auditSink, err := webchat.NewAuditSink(config)
+	if err != nil {
+		logrus.Fatalf("Error creating audit sink: %s", err)
+	}
+	hub.SetAuditSink(auditSink)
+	historyStore, err := webchat.NewHistoryStore(config)
+	if err != nil {
+		logrus.Fatalf("Error creating history store: %s", err)
+	}
+	hub.SetHistoryStore(historyStore)
+	var greetingStore webchat.GreetingStore
+	if config.GreetingStorePath != "" {
+		greetingStore, err = webchat.NewBoltGreetingStore(config.GreetingStorePath)
+		if err != nil {
+			logrus.Fatalf("Error creating greeting store: %s", err)
+		}
+		hub.SetGreetingStore(greetingStore)
+	}
+	if config.OutboxPath != "" {
+		outbox, err := webchat.NewOutbox(hub, config.OutboxPath)
+		if err != nil {
+			logrus.Fatalf("Error opening outbox: %s", err)
+		}
+		hub.SetOutbox(outbox)
+		outbox.Start(s.WaitGroup(), s.StopChan())
+	}
+	err = hub.LoadLocales()
+	if err != nil {
+		logrus.Fatalf("Error loading locales: %s", err)
+	}
+	err = hub.Channels().Load()
+	if err != nil {
+		logrus.Fatalf("Error loading channels: %s", err)
+	}
+	go hub.Run()
+	s.OnConfigReload(hub.SetConfig)
+	s.OnConfigReload(func(*server.Config) {
+		if err := hub.Channels().Load(); err != nil {
+			logrus.WithField("comp", "main").WithError(err).Error("error reloading channels, keeping current ones")
+		}
+		if err := hub.LoadLocales(); err != nil {
+			logrus.WithField("comp", "main").WithError(err).Error("error reloading locales, keeping current ones")
+		}
+	})
+	if config.CourierAuthToken == "" && config.CourierHMACSecret == "" {
+		if hub.Channels().Secured() {
+			logrus.WithField("comp", "main").Warn("only channels have courier secrets, batches, presence queries and requests for other channels will be rejected")
+		} else {
+			logrus.WithField("comp", "main").Warn("no courier auth token or HMAC secret configured, anyone can post messages")
+		}
+	}
+
+	// add our main routes
 	s.Router().Get("/", webchat.Index)
-	s.Router().Post("/", func(w http.ResponseWriter, r *http.Request) { webchat.MessageReceived(hub, w, r) })
-	s.Router().Get("/ping", func(w http.ResponseWriter, r *http.Request) { webchat.Ping(serverStartTime, w, r) })
+	s.Router().With(webchat.CourierAuth(hub)).Post("/", func(w http.ResponseWriter, r *http.Request) { webchat.MessageReceived(hub, w, r) })
+	s.Router().With(webchat.CourierAuth(hub)).Post("/batch", func(w http.ResponseWriter, r *http.Request) { webchat.BatchMessagesReceived(hub, w, r) })
+	s.Router().With(webchat.CourierAuth(hub)).Post("/event", func(w http.ResponseWriter, r *http.Request) { webchat.EventReceived(hub, w, r) })
+	s.Router().With(webchat.CourierAuth(hub)).Get("/presence", func(w http.ResponseWriter, r *http.Request) { webchat.PresenceQuery(hub, w, r) })
+	s.Router().Get("/ping", func(w http.ResponseWriter, r *http.Request) { webchat.Ping(hub, serverStartTime, w, r) })
 	s.Router().Get("/socketcluster", func(w http.ResponseWriter, r *http.Request) { webchat.ServeWS(hub, w, r) })
+	s.Router().Get("/agent", func(w http.ResponseWriter, r *http.Request) { webchat.ServeAgentWS(hub, w, r) })
 	err = s.Start()
 	if err != nil {
 		logrus.Fatalf("Error starting server: %s", err)
 	}
+	hub.Channels().Start(s.WaitGroup(), s.StopChan())
 
-	// stop server on signal received
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	logrus.WithField("comp", "main").WithField("signal", <-ch).Info("stopping")
+	// reload config and certificates on SIGHUP, stop server on any other signal received
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range ch {
+		if sig == syscall.SIGHUP {
+			if err := s.ReloadConfig(); err != nil {
+				logrus.WithField("comp", "main").WithError(err).Error("error reloading config")
+			}
+			if err := s.ReloadTLS(); err != nil {
+				logrus.WithField("comp", "main").WithError(err).Error("error reloading TLS certificate")
+			}
+			continue
+		}
+
+		logrus.WithField("comp", "main").WithField("signal", sig).Info("stopping")
+		break
+	}
 	s.Stop()
+
+	if auditSink != nil {
+		auditSink.Close()
+	}
+	if historyStore != nil {
+		historyStore.Close()
+	}
+	if greetingStore != nil {
+		greetingStore.Close()
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		logrus.WithField("comp", "main").WithError(err).Error("error flushing traces")
+	}
 }
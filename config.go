@@ -1,15 +1,127 @@
 package ccl_chatbot_server
 
-import "github.com/nyaruka/ezconf"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 
-// Config is our top level configuration object
+	"github.com/greatnonprofits-nfp/websocket-go/utils"
+	"github.com/nyaruka/ezconf"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/text/language"
+)
+
+// envPrefix is prepended to the snake case name of every setting to build its environment variable,
+// for example Port can be set with CHATBOT_SERVER_PORT and WSPingInterval with CHATBOT_SERVER_WS_PING_INTERVAL
+const envPrefix = "chatbot_server"
+
+// Config is our top level configuration object. Settings are read, in increasing priority, from the
+// defaults below, a TOML file, environment variables and command line flags.
 type Config struct {
+	Config              string `help:"the path of the TOML file configuration is loaded from"`
+	ConfigWatchInterval int    `help:"the number of seconds between checks of the config file for changes, 0 disables reloading on change"`
+
 	Domain    string `help:"the domain courier is exposed on"`
 	Address   string `help:"the network interface address courier will bind to"`
 	Port      int    `help:"the port courier will listen on"`
 	SentryDSN string `help:"the DSN used for logging errors to Sentry"`
 	LogLevel  string `help:"the logging level courier should use"`
 	Version   string `help:"the version that will be used in request and response headers"`
+
+	HTTPReadTimeout  int `help:"the number of seconds allowed to read an HTTP request"`
+	HTTPWriteTimeout int `help:"the number of seconds allowed to write an HTTP response"`
+	RequestTimeout   int `help:"the number of seconds an HTTP handler may run before it is cancelled"`
+
+	TLSCertFile     string `help:"the path to the TLS certificate file, enables HTTPS when set along with the key file"`
+	TLSKeyFile      string `help:"the path to the TLS private key file"`
+	TLSMinVersion   string `help:"the minimum TLS version accepted, one of 1.0, 1.1, 1.2 or 1.3"`
+	TLSCipherSuites string `help:"comma separated list of TLS cipher suite names, Go defaults are used when empty"`
+
+	ACMEEnabled      bool   `help:"whether certificates should be obtained automatically from an ACME directory"`
+	ACMEDirectoryURL string `help:"the URL of the ACME directory certificates are requested from"`
+	ACMEHosts        string `help:"comma separated list of host names certificates may be requested for"`
+	ACMEEmail        string `help:"the contact email registered with the ACME directory"`
+	ACMECacheDir     string `help:"the directory ACME certificates and account keys are cached in"`
+	ACMEInsecure     bool   `help:"whether to skip verification of the ACME directory's certificate, only for testing"`
+
+	CourierAuthToken   string `help:"the bearer token courier must send when posting messages, courier requests are not authenticated when this, courier_hmac_secret and every channel's secrets are empty"`
+	CourierHMACSecret  string `help:"the secret courier must sign the timestamp and body of posted messages with using HMAC-SHA256"`
+	CourierHMACMaxSkew int    `help:"the number of seconds a signed courier request is valid for, protecting against replays"`
+
+	AgentTokens         string `help:"comma separated list of tokens agents can connect with to channels which don't define their own, agents can't connect when empty"`
+	AgentAllowedOrigins string `help:"comma separated list of origins agent consoles may connect from, any origin is allowed when empty as agents authenticate with a token"`
+
+	MaxBodySize      int64 `help:"the maximum size in bytes of a message posted by courier"`
+	BatchMaxBodySize int64 `help:"the maximum size in bytes of a batch of messages posted by courier"`
+	BatchMaxMessages int   `help:"the maximum number of messages in a batch posted by courier"`
+
+	ChannelsFile            string `help:"the path of a JSON file defining channels, websocket clients can only connect to defined channels when this or channels_url is set"`
+	ChannelsURL             string `help:"the URL of an admin API channel definitions are fetched from as JSON"`
+	ChannelsAPIToken        string `help:"the bearer token sent when fetching channel definitions from channels_url"`
+	ChannelsRefreshInterval int    `help:"the number of seconds between reloads of channel definitions, 0 only loads them on startup and reload"`
+
+	SessionGracePeriod int `help:"the number of seconds a disconnected websocket client can resume its session for, 0 disables resumption"`
+	SessionBufferSize  int `help:"the number of messages from courier kept for a disconnected websocket client until it resumes its session"`
+
+	VisitorCookie        string `help:"the name of the cookie giving websocket clients a stable visitor id across connections, empty disables it"`
+	VisitorSecret        string `help:"the secret visitor cookies are signed with, visitor cookies are only used when this is set"`
+	VisitorCookieMaxAge  int    `help:"the number of seconds visitor cookies are kept by browsers for"`
+	RegistrationCacheTTL int    `help:"the number of seconds contacts registered with courier are reused for repeat registrations by the same visitor, 0 disables caching"`
+
+	Languages  string `help:"comma separated list of the languages server generated text is sent to widgets in, the first being used when none of them match"`
+	LocalesDir string `help:"the directory of translation catalogs, JSON files named after their language, which add to and override our own"`
+
+	PresenceIdleTimeout int    `help:"the number of seconds without activity after which a connected contact is idle, 0 never considers contacts idle"`
+	PresenceDebounce    int    `help:"the number of seconds a disconnected contact has to reconnect before going offline, so quick reconnects don't change presence"`
+	PresenceWebhookURL  string `help:"the URL presence changes are posted to, or courier to post them to the contact's courier, empty doesn't post them"`
+
+	HistoryPageSize    int `help:"the number of history messages sent to widgets asking for a page of history without a limit"`
+	HistoryMaxPageSize int `help:"the largest number of history messages widgets can ask for in one page"`
+
+	HistoryStore     string `help:"where the conversation history of contacts is kept besides courier, bolt or empty to only use courier"`
+	HistoryStorePath string `help:"the path of the BoltDB file history is kept in when history_store is bolt"`
+	HistoryRetention int    `help:"the number of days messages are kept in the history store, 0 keeps them forever"`
+
+	GreetingStorePath string `help:"the path of the BoltDB file recording which contacts have been greeted, channel welcome messages and triggers are only sent to new contacts when this is set"`
+
+	OutboxPath          string `help:"the path of the write-ahead log messages from contacts that courier couldn't be reached for are kept in to be retried, empty disables retrying"`
+	OutboxRetryInterval int    `help:"the number of seconds between retries of messages in the outbox, doubled after each failed attempt"`
+	OutboxMaxAttempts   int    `help:"the number of times a message in the outbox is tried before giving up on it, 0 never gives up"`
+
+	HubQueueSize int `help:"the number of messages from courier that can wait to be routed to websocket clients before new ones are rejected"`
+
+	AllowedOrigins string `help:"comma separated list of origins websocket clients may connect from, any origin is allowed when empty"`
+	CourierHosts   string `help:"comma separated list of courier hosts websocket clients may use as their host API, any host is allowed when empty"`
+
+	AuditSink         string  `help:"where courier exchanges are recorded, one of stdout or file, auditing is disabled when empty"`
+	AuditFile         string  `help:"the path of the JSON lines file courier exchanges are appended to when audit_sink is file"`
+	AuditSampleRate   float64 `help:"the fraction of successful courier exchanges that are recorded, failures are always recorded"`
+	AuditMaxTraceSize int     `help:"the maximum size in bytes of each recorded request and response trace, 0 for no limit"`
+
+	TracingExporter   string  `help:"where OpenTelemetry spans are exported, one of otlp or stdout, tracing is disabled when empty"`
+	TracingEndpoint   string  `help:"the host and port of the OTLP HTTP collector spans are exported to"`
+	TracingInsecure   bool    `help:"whether spans are exported to the OTLP collector over plain HTTP"`
+	TracingSampleRate float64 `help:"the fraction of new traces that are sampled, traces started by callers follow their decision"`
+
+	WSOutboundFormat string `help:"how messages from courier are sent to clients that don't ask for a format, one of publish, event or both"`
+
+	WSHandshakeTimeout int `help:"the number of seconds allowed to complete a websocket upgrade"`
+	WSPingInterval     int `help:"the number of seconds between pings sent to websocket clients"`
+	WSPingTimeout      int `help:"the number of seconds without a pong or message before a websocket client is disconnected"`
+
+	WSMaxMessageSize     int64 `help:"the maximum size in bytes of a single message read from a websocket client"`
+	WSAllowBinary        bool  `help:"whether binary websocket frames are accepted from clients"`
+	WSMaxInvalidMessages int   `help:"the number of malformed messages a websocket client may send before being disconnected"`
+
+	WSReadBufferSize       int  `help:"the size in bytes of the read buffer allocated for each websocket connection"`
+	WSWriteBufferSize      int  `help:"the size in bytes of the pooled write buffers shared by websocket connections"`
+	WSEnableCompression    bool `help:"whether permessage-deflate compression is negotiated with websocket clients"`
+	WSCompressionLevel     int  `help:"the flate compression level used for websocket messages, from -2 to 9"`
+	WSCompressionThreshold int  `help:"the minimum size in bytes of a websocket message before it is compressed"`
 }
 
 // NewConfig returns a new default configuration object
@@ -20,18 +132,300 @@ func NewConfig() *Config {
 		Port:     9090,
 		LogLevel: "debug",
 		Version:  "Dev",
+
+		ConfigWatchInterval: 0,
+
+		HTTPReadTimeout:  30,
+		HTTPWriteTimeout: 30,
+		RequestTimeout:   30,
+
+		TLSMinVersion: "1.2",
+
+		ACMEDirectoryURL: autocert.DefaultACMEDirectory,
+		ACMECacheDir:     "acme-cache",
+
+		CourierHMACMaxSkew: 300,
+
+		MaxBodySize:      100000,
+		BatchMaxBodySize: 5000000,
+		BatchMaxMessages: 1000,
+
+		ChannelsRefreshInterval: 300,
+
+		SessionGracePeriod: 60,
+		SessionBufferSize:  50,
+
+		VisitorCookie:        "chatbot_visitor",
+		VisitorCookieMaxAge:  31536000,
+		RegistrationCacheTTL: 3600,
+
+		Languages: "en",
+
+		PresenceIdleTimeout: 300,
+		PresenceDebounce:    10,
+
+		HistoryPageSize:    50,
+		HistoryMaxPageSize: 200,
+
+		HistoryStorePath: "history.db",
+		HistoryRetention: 30,
+
+		OutboxRetryInterval: 5,
+		OutboxMaxAttempts:   50,
+
+		HubQueueSize: 1000,
+
+		AuditSampleRate:   1,
+		AuditMaxTraceSize: 10000,
+
+		TracingEndpoint:   "localhost:4318",
+		TracingSampleRate: 1,
+
+		WSOutboundFormat: "both",
+
+		WSHandshakeTimeout: 8,
+		WSPingInterval:     10,
+		WSPingTimeout:      20,
+
+		WSMaxMessageSize:     65536,
+		WSAllowBinary:        false,
+		WSMaxInvalidMessages: 5,
+
+		WSReadBufferSize:       1024,
+		WSWriteBufferSize:      1024,
+		WSEnableCompression:    false,
+		WSCompressionLevel:     1,
+		WSCompressionThreshold: 1024,
 	}
 }
 
-// LoadConfig loads our configuration from the passed in filename
+// LoadConfig loads our configuration from the passed in filename, unless it is overridden by the
+// -config flag or the CHATBOT_SERVER_CONFIG environment variable
 func LoadConfig(filename string) *Config {
+	filename = configFilename(filename, os.Args[1:])
+
 	config := NewConfig()
-	loader := ezconf.NewLoader(
+	newLoader(config, filename).MustLoad()
+	config.Config = filename
+	return config
+}
+
+// newLoader creates the ezconf loader which reads our config from the passed in file, environment and flags
+func newLoader(config *Config, filename string) *ezconf.EZLoader {
+	return ezconf.NewLoader(
 		config,
-		"chatbot-server", "Chatbot Server - A fast message broker for WebSocket messages",
+		envPrefix, "Chatbot Server - A fast message broker for WebSocket messages",
 		[]string{filename},
 	)
+}
 
-	loader.MustLoad()
-	return config
+// configFilename looks for an override of the config file in our arguments and environment, we need it
+// before ezconf parses them since the file is read first
+func configFilename(filename string, args []string) string {
+	if env := os.Getenv(strings.ToUpper(envPrefix + "_config")); env != "" {
+		filename = env
+	}
+
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if name == "config" && i+1 < len(args) {
+			filename = args[i+1]
+		} else if strings.HasPrefix(name, "config=") {
+			filename = strings.TrimPrefix(name, "config=")
+		}
+	}
+	return filename
+}
+
+// Validate checks every setting of our config, returning a single error describing all the invalid ones
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		addProblem("port must be between 1 and 65535, got %d", c.Port)
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		addProblem("log_level is invalid: %s", c.LogLevel)
+	}
+	if c.ConfigWatchInterval < 0 {
+		addProblem("config_watch_interval can't be negative, got %d", c.ConfigWatchInterval)
+	}
+	if c.HTTPReadTimeout <= 0 {
+		addProblem("http_read_timeout must be positive, got %d", c.HTTPReadTimeout)
+	}
+	if c.HTTPWriteTimeout <= 0 {
+		addProblem("http_write_timeout must be positive, got %d", c.HTTPWriteTimeout)
+	}
+	if c.RequestTimeout <= 0 {
+		addProblem("request_timeout must be positive, got %d", c.RequestTimeout)
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		addProblem("tls_cert_file and tls_key_file must be set together")
+	}
+	if _, found := tlsVersions[c.TLSMinVersion]; !found {
+		addProblem("tls_min_version must be one of 1.0, 1.1, 1.2 or 1.3, got %s", c.TLSMinVersion)
+	}
+	if _, err := parseCipherSuites(c.TLSCipherSuites); err != nil {
+		addProblem("tls_cipher_suites is invalid: %s", err)
+	}
+	if c.ACMEEnabled {
+		if c.TLSCertFile != "" {
+			addProblem("acme_enabled can't be used with tls_cert_file")
+		}
+		if strings.TrimSpace(c.ACMEHosts) == "" {
+			addProblem("acme_hosts must be set when acme_enabled is set")
+		}
+		if u, err := url.Parse(c.ACMEDirectoryURL); err != nil || u.Scheme == "" || u.Host == "" {
+			addProblem("acme_directory_url is not a valid URL: %s", c.ACMEDirectoryURL)
+		}
+		if c.ACMECacheDir == "" {
+			addProblem("acme_cache_dir must be set when acme_enabled is set")
+		}
+	}
+
+	if c.CourierHMACMaxSkew <= 0 {
+		addProblem("courier_hmac_max_skew must be positive, got %d", c.CourierHMACMaxSkew)
+	}
+
+	if c.MaxBodySize <= 0 {
+		addProblem("max_body_size must be positive, got %d", c.MaxBodySize)
+	}
+	if c.BatchMaxBodySize < c.MaxBodySize {
+		addProblem("batch_max_body_size can't be less than max_body_size, got %d", c.BatchMaxBodySize)
+	}
+	if c.BatchMaxMessages <= 0 {
+		addProblem("batch_max_messages must be positive, got %d", c.BatchMaxMessages)
+	}
+	if c.ChannelsFile != "" && c.ChannelsURL != "" {
+		addProblem("only one of channels_file and channels_url can be set")
+	}
+	if c.ChannelsURL != "" {
+		if u, err := url.Parse(c.ChannelsURL); err != nil || u.Scheme == "" || u.Host == "" {
+			addProblem("channels_url must be an absolute URL, got %s", c.ChannelsURL)
+		}
+	}
+	if c.ChannelsRefreshInterval < 0 {
+		addProblem("channels_refresh_interval can't be negative, got %d", c.ChannelsRefreshInterval)
+	}
+	if c.SessionGracePeriod < 0 {
+		addProblem("session_grace_period can't be negative, got %d", c.SessionGracePeriod)
+	}
+	if c.SessionBufferSize < 0 {
+		addProblem("session_buffer_size can't be negative, got %d", c.SessionBufferSize)
+	}
+	if c.VisitorCookie != "" && (&http.Cookie{Name: c.VisitorCookie, Value: "x"}).Valid() != nil {
+		addProblem("visitor_cookie isn't a valid cookie name, got %q", c.VisitorCookie)
+	}
+	if c.VisitorCookieMaxAge < 0 {
+		addProblem("visitor_cookie_max_age can't be negative, got %d", c.VisitorCookieMaxAge)
+	}
+	if c.RegistrationCacheTTL < 0 {
+		addProblem("registration_cache_ttl can't be negative, got %d", c.RegistrationCacheTTL)
+	}
+	for _, code := range utils.SplitList(c.Languages) {
+		if _, err := language.Parse(code); err != nil {
+			addProblem("languages must be a list of valid language codes, got %s", code)
+		}
+	}
+	if c.PresenceIdleTimeout < 0 {
+		addProblem("presence_idle_timeout can't be negative, got %d", c.PresenceIdleTimeout)
+	}
+	if c.PresenceDebounce < 0 {
+		addProblem("presence_debounce can't be negative, got %d", c.PresenceDebounce)
+	}
+	if c.PresenceWebhookURL != "" && c.PresenceWebhookURL != "courier" {
+		if u, err := url.Parse(c.PresenceWebhookURL); err != nil || u.Scheme == "" || u.Host == "" {
+			addProblem("presence_webhook_url must be a valid URL or courier, got %s", c.PresenceWebhookURL)
+		}
+	}
+	if c.HistoryMaxPageSize <= 0 {
+		addProblem("history_max_page_size must be positive, got %d", c.HistoryMaxPageSize)
+	}
+	if c.HistoryPageSize <= 0 || c.HistoryPageSize > c.HistoryMaxPageSize {
+		addProblem("history_page_size must be between 1 and history_max_page_size, got %d", c.HistoryPageSize)
+	}
+	if c.HistoryStore != "" && c.HistoryStore != "bolt" {
+		addProblem("history_store must be bolt or empty, got %s", c.HistoryStore)
+	}
+	if c.HistoryStore == "bolt" && c.HistoryStorePath == "" {
+		addProblem("history_store_path is required when history_store is bolt")
+	}
+	if c.HistoryRetention < 0 {
+		addProblem("history_retention can't be negative, got %d", c.HistoryRetention)
+	}
+	if c.OutboxRetryInterval <= 0 {
+		addProblem("outbox_retry_interval must be positive, got %d", c.OutboxRetryInterval)
+	}
+	if c.OutboxMaxAttempts < 0 {
+		addProblem("outbox_max_attempts can't be negative, got %d", c.OutboxMaxAttempts)
+	}
+	if c.HubQueueSize <= 0 {
+		addProblem("hub_queue_size must be positive, got %d", c.HubQueueSize)
+	}
+
+	if c.AuditSink != "" && c.AuditSink != "stdout" && c.AuditSink != "file" {
+		addProblem("audit_sink must be one of stdout or file, got %s", c.AuditSink)
+	}
+	if c.AuditSink == "file" && c.AuditFile == "" {
+		addProblem("audit_file must be set when audit_sink is file")
+	}
+	if c.AuditSampleRate < 0 || c.AuditSampleRate > 1 {
+		addProblem("audit_sample_rate must be between 0 and 1, got %g", c.AuditSampleRate)
+	}
+	if c.AuditMaxTraceSize < 0 {
+		addProblem("audit_max_trace_size can't be negative, got %d", c.AuditMaxTraceSize)
+	}
+
+	if c.TracingExporter != "" && c.TracingExporter != "otlp" && c.TracingExporter != "stdout" {
+		addProblem("tracing_exporter must be one of otlp or stdout, got %s", c.TracingExporter)
+	}
+	if c.TracingExporter == "otlp" && c.TracingEndpoint == "" {
+		addProblem("tracing_endpoint must be set when tracing_exporter is otlp")
+	}
+	if c.TracingSampleRate < 0 || c.TracingSampleRate > 1 {
+		addProblem("tracing_sample_rate must be between 0 and 1, got %g", c.TracingSampleRate)
+	}
+
+	if c.WSOutboundFormat != "publish" && c.WSOutboundFormat != "event" && c.WSOutboundFormat != "both" {
+		addProblem("ws_outbound_format must be one of publish, event or both, got %s", c.WSOutboundFormat)
+	}
+	if c.WSHandshakeTimeout <= 0 {
+		addProblem("ws_handshake_timeout must be positive, got %d", c.WSHandshakeTimeout)
+	}
+	if c.WSPingInterval <= 0 {
+		addProblem("ws_ping_interval must be positive, got %d", c.WSPingInterval)
+	}
+	if c.WSPingTimeout <= c.WSPingInterval {
+		addProblem("ws_ping_timeout must be greater than ws_ping_interval, got %d", c.WSPingTimeout)
+	}
+	if c.WSMaxMessageSize <= 0 {
+		addProblem("ws_max_message_size must be positive, got %d", c.WSMaxMessageSize)
+	}
+	if c.WSMaxInvalidMessages <= 0 {
+		addProblem("ws_max_invalid_messages must be positive, got %d", c.WSMaxInvalidMessages)
+	}
+	if c.WSReadBufferSize <= 0 {
+		addProblem("ws_read_buffer_size must be positive, got %d", c.WSReadBufferSize)
+	}
+	if c.WSWriteBufferSize <= 0 {
+		addProblem("ws_write_buffer_size must be positive, got %d", c.WSWriteBufferSize)
+	}
+	if c.WSCompressionLevel < -2 || c.WSCompressionLevel > 9 {
+		addProblem("ws_compression_level must be between -2 and 9, got %d", c.WSCompressionLevel)
+	}
+	if c.WSCompressionThreshold < 0 {
+		addProblem("ws_compression_threshold can't be negative, got %d", c.WSCompressionThreshold)
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
 }
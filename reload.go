@@ -0,0 +1,133 @@
+package ccl_chatbot_server
+
+import (
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/nyaruka/ezconf"
+	"github.com/sirupsen/logrus"
+)
+
+// restartFields are the settings that are only read when the server starts, changing them in a running
+// server has no effect until it is restarted
+var restartFields = []string{
+	"Config", "Address", "Port", "SentryDSN", "Version",
+	"HTTPReadTimeout", "HTTPWriteTimeout", "RequestTimeout",
+	"TLSCertFile", "TLSKeyFile", "TLSMinVersion", "TLSCipherSuites",
+	"ACMEEnabled", "ACMEDirectoryURL", "ACMEHosts", "ACMEEmail", "ACMECacheDir", "ACMEInsecure",
+	"WSHandshakeTimeout", "WSReadBufferSize", "WSWriteBufferSize", "WSEnableCompression",
+	"AuditSink", "AuditFile", "ConfigWatchInterval", "HubQueueSize",
+	"HistoryStore", "HistoryStorePath", "HistoryRetention", "GreetingStorePath", "OutboxPath", "ChannelsRefreshInterval",
+	"TracingExporter", "TracingEndpoint", "TracingInsecure", "TracingSampleRate",
+}
+
+// ReadConfig loads our configuration from the passed in filename like LoadConfig, but returns any error
+// instead of exiting
+func ReadConfig(filename string) (*Config, error) {
+	config := NewConfig()
+	if err := newLoader(config, filename).Load(); err != nil {
+		return nil, err
+	}
+	config.Config = filename
+	return config, nil
+}
+
+// keepRestartFields copies the settings that can't be changed while running from the current config into
+// the new one, returning the names of those that were different
+func keepRestartFields(current *Config, config *Config) []string {
+	changed := make([]string, 0)
+	currentValue := reflect.ValueOf(current).Elem()
+	newValue := reflect.ValueOf(config).Elem()
+
+	for _, name := range restartFields {
+		currentField := currentValue.FieldByName(name)
+		newField := newValue.FieldByName(name)
+		if !reflect.DeepEqual(currentField.Interface(), newField.Interface()) {
+			changed = append(changed, ezconf.CamelToSnake(name))
+			newField.Set(currentField)
+		}
+	}
+	return changed
+}
+
+// ReloadConfig reads our config file again and applies every setting that can be changed while running,
+// listeners added with OnConfigReload are then called with the new config. Settings that need a restart
+// keep their current values and are logged.
+func (s *server) ReloadConfig() error {
+	log := s.logger.WithField("comp", "server")
+	current := s.Config()
+
+	config, err := ReadConfig(current.Config)
+	if err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	restart := keepRestartFields(current, config)
+	if len(restart) > 0 {
+		log.WithField("settings", restart).Warn("changed settings will only be applied after a restart")
+	}
+
+	level, _ := logrus.ParseLevel(config.LogLevel)
+	s.logger.SetLevel(level)
+	s.config.Store(config)
+
+	s.reloadMutex.Lock()
+	listeners := s.reloadListeners
+	s.reloadMutex.Unlock()
+	for _, listener := range listeners {
+		listener(config)
+	}
+
+	log.WithField("state", "reloaded").Info("configuration reloaded")
+	return nil
+}
+
+// OnConfigReload adds a function which will be called with the new config every time it is reloaded
+func (s *server) OnConfigReload(listener func(*Config)) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	s.reloadListeners = append(s.reloadListeners, listener)
+}
+
+// watchConfig polls our config file for modifications, reloading it whenever it changes
+func (s *server) watchConfig(interval time.Duration) {
+	defer s.waitGroup.Done()
+	log := s.logger.WithField("comp", "config_watcher")
+
+	filename := s.Config().Config
+	modified := fileModTime(filename)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+			latest := fileModTime(filename)
+			if latest.Equal(modified) {
+				continue
+			}
+			modified = latest
+
+			log.WithField("file", filename).Info("config file changed, reloading")
+			if err := s.ReloadConfig(); err != nil {
+				log.WithError(err).Error("error reloading config")
+			}
+		}
+	}
+}
+
+// fileModTime returns when the passed in file was last modified, or the zero time if it can't be read
+func fileModTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
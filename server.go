@@ -10,6 +10,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +18,7 @@ import (
 // abstraction that makes mocking easier for isolated unit tests
 type Server interface {
 	Config() *Config
+	Logger() *logrus.Logger
 
 	WaitGroup() *sync.WaitGroup
 	StopChan() chan bool
@@ -26,14 +28,15 @@ type Server interface {
 
 	Start() error
 	Stop() error
+	ReloadTLS() error
+	ReloadConfig() error
+	OnConfigReload(func(*Config))
 }
 
 // NewServer creates a new Server for the passed in configuration. The server will have to be started
 // afterwards, which is when configuration options are checked.
 func NewServer(config *Config) Server {
-	// create our top level router
-	logger := logrus.New()
-	return NewServerWithLogger(config, logger)
+	return NewServerWithLogger(config, logrus.StandardLogger())
 }
 
 // NewServerWithLogger creates a new Server for the passed in configuration. The server will have to be started
@@ -45,25 +48,31 @@ func NewServerWithLogger(config *Config, logger *logrus.Logger) Server {
 	router.Use(middleware.RequestID)
 	router.Use(middleware.RealIP)
 	router.Use(middleware.Recoverer)
-	router.Use(middleware.Timeout(30 * time.Second))
-
-	return &server{
-		config: config,
+	router.Use(middleware.Timeout(time.Duration(config.RequestTimeout) * time.Second))
 
+	s := &server{
 		router: router,
+		logger: logger,
 
 		stopChan:  make(chan bool),
 		waitGroup: &sync.WaitGroup{},
 		stopped:   false,
 	}
+	s.config.Store(config)
+	return s
 }
 
 // Start starts the Server listening for incoming requests and sending messages. It will return an error
 // if it encounters any unrecoverable (or ignorable) error, though its bias is to move forward despite
 // connection errors
 func (s *server) Start() error {
+	config := s.Config()
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %s", err)
+	}
+
 	// set our user agent, needs to happen before we do anything so we don't change have threading issues
-	utils.HTTPUserAgent = fmt.Sprintf("Courier/%s", s.config.Version)
+	utils.HTTPUserAgent = fmt.Sprintf("Courier/%s", config.Version)
 
 	// wire up our main pages
 	s.router.NotFound(s.handle404)
@@ -71,19 +80,33 @@ func (s *server) Start() error {
 
 	// configure timeouts on our server
 	s.httpServer = &http.Server{
-		Addr:         fmt.Sprintf("%s:%d", s.config.Address, s.config.Port),
+		Addr:         fmt.Sprintf("%s:%d", config.Address, config.Port),
 		Handler:      s.router,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		ReadTimeout:  time.Duration(config.HTTPReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(config.HTTPWriteTimeout) * time.Second,
+	}
+
+	// serve HTTPS if we have certificates or ACME configured
+	if config.TLSEnabled() {
+		tlsConfig, err := s.buildTLSConfig()
+		if err != nil {
+			return err
+		}
+		s.httpServer.TLSConfig = tlsConfig
 	}
 
 	// and start serving HTTP
+	s.waitGroup.Add(1)
 	go func() {
-		s.waitGroup.Add(1)
 		defer s.waitGroup.Done()
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
 		if err != nil && err != http.ErrServerClosed {
-			logrus.WithFields(logrus.Fields{
+			s.logger.WithFields(logrus.Fields{
 				"comp":  "server",
 				"state": "stopping",
 				"err":   err,
@@ -91,18 +114,25 @@ func (s *server) Start() error {
 		}
 	}()
 
-	logrus.WithFields(logrus.Fields{
+	// reload our config whenever its file changes if asked to
+	if config.ConfigWatchInterval > 0 {
+		s.waitGroup.Add(1)
+		go s.watchConfig(time.Duration(config.ConfigWatchInterval) * time.Second)
+	}
+
+	s.logger.WithFields(logrus.Fields{
 		"comp":    "server",
-		"port":    s.config.Port,
+		"port":    config.Port,
 		"state":   "started",
-		"version": s.config.Version,
-	}).Info("server listening on ", s.config.Port)
+		"tls":     config.TLSEnabled(),
+		"version": config.Version,
+	}).Info("server listening on ", config.Port)
 
 	return nil
 }
 
 func (s *server) Stop() error {
-	log := logrus.WithField("comp", "server")
+	log := s.logger.WithField("comp", "server")
 	log.WithField("state", "stopping").Info("stopping server")
 
 	// shut down our HTTP server
@@ -123,15 +153,20 @@ func (s *server) Stop() error {
 
 func (s *server) WaitGroup() *sync.WaitGroup { return s.waitGroup }
 func (s *server) StopChan() chan bool        { return s.stopChan }
-func (s *server) Config() *Config            { return s.config }
+func (s *server) Config() *Config            { return s.config.Load().(*Config) }
 func (s *server) Stopped() bool              { return s.stopped }
 func (s *server) Router() chi.Router         { return s.router }
+func (s *server) Logger() *logrus.Logger     { return s.logger }
 
 type server struct {
-	httpServer *http.Server
-	router     *chi.Mux
+	httpServer   *http.Server
+	router       *chi.Mux
+	certReloader *certReloader
+	logger       *logrus.Logger
 
-	config *Config
+	config          atomic.Value
+	reloadMutex     sync.Mutex
+	reloadListeners []func(*Config)
 
 	waitGroup *sync.WaitGroup
 	stopChan  chan bool
@@ -141,17 +176,28 @@ type server struct {
 }
 
 func (s *server) handle404(w http.ResponseWriter, r *http.Request) {
-	logrus.WithField("url", r.URL.String()).WithField("method", r.Method).WithField("resp_status", "404").Info("not found")
+	log := s.requestLogger(r)
+	log.WithField("resp_status", "404").Info("not found")
 	_, err := fmt.Fprintf(w, "Not Found")
 	if err != nil {
-		logrus.WithError(err).Error()
+		log.WithError(err).Error()
 	}
 }
 
 func (s *server) handle405(w http.ResponseWriter, r *http.Request) {
-	logrus.WithField("url", r.URL.String()).WithField("method", r.Method).WithField("resp_status", "405").Info("invalid method")
+	log := s.requestLogger(r)
+	log.WithField("resp_status", "405").Info("invalid method")
 	_, err := fmt.Fprintf(w, "Method Not Allowed")
 	if err != nil {
-		logrus.WithError(err).Error()
+		log.WithError(err).Error()
 	}
 }
+
+// requestLogger returns a logger with the URL, method and request ID of the passed in request
+func (s *server) requestLogger(r *http.Request) *logrus.Entry {
+	return s.logger.WithFields(logrus.Fields{
+		"url":        r.URL.String(),
+		"method":     r.Method,
+		"request_id": middleware.GetReqID(r.Context()),
+	})
+}
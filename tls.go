@@ -0,0 +1,147 @@
+package ccl_chatbot_server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/greatnonprofits-nfp/websocket-go/utils"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSEnabled returns whether the server should serve HTTPS, either from certificate files or through ACME
+func (c *Config) TLSEnabled() bool {
+	return c.ACMEEnabled || (c.TLSCertFile != "" && c.TLSKeyFile != "")
+}
+
+// certReloader keeps the certificate loaded from disk, allowing it to be swapped out without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reload reads our certificate and key files again, keeping the current certificate if they are invalid
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate: %s", err)
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuites parses a comma separated list of cipher suite names, an empty list means Go's defaults
+func parseCipherSuites(names string) ([]uint16, error) {
+	if strings.TrimSpace(names) == "" {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	suites := make([]uint16, 0)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, found := known[name]
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %s", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// buildTLSConfig creates the TLS configuration for our HTTP server from our config
+func (s *server) buildTLSConfig() (*tls.Config, error) {
+	config := s.Config()
+	minVersion, found := tlsVersions[config.TLSMinVersion]
+	if !found {
+		return nil, fmt.Errorf("invalid TLS min version: %s", config.TLSMinVersion)
+	}
+
+	cipherSuites, err := parseCipherSuites(config.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+	}
+
+	if config.ACMEEnabled {
+		hosts := utils.SplitList(config.ACMEHosts)
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("ACME requires at least one host")
+		}
+
+		client := &acme.Client{DirectoryURL: config.ACMEDirectoryURL}
+		if config.ACMEInsecure {
+			client.HTTPClient = utils.GetInsecureHTTPClient()
+		}
+
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(config.ACMECacheDir),
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Email:      config.ACMEEmail,
+			Client:     client,
+		}
+		tlsConfig.GetCertificate = manager.GetCertificate
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		return tlsConfig, nil
+	}
+
+	reloader, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	s.certReloader = reloader
+	tlsConfig.GetCertificate = reloader.getCertificate
+	return tlsConfig, nil
+}
+
+// ReloadTLS reloads our certificate and key files, this is a noop if we aren't serving certificates from files
+func (s *server) ReloadTLS() error {
+	if s.certReloader == nil {
+		return nil
+	}
+
+	if err := s.certReloader.reload(); err != nil {
+		return err
+	}
+
+	s.logger.WithField("comp", "server").WithField("cert_file", s.certReloader.certFile).Info("reloaded TLS certificate")
+	return nil
+}
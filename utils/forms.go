@@ -3,19 +3,58 @@ package utils
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
 
 	validator "gopkg.in/go-playground/validator.v9"
 )
 
-var validate = validator.New()
+var validate = newValidator()
 
-// ReadBody of a HTTP request up to limit bytes and make sure the Body is not consumed
+// Validate checks the passed in struct against its validate tags
+func Validate(value interface{}) error {
+	return validate.Struct(value)
+}
+
+// newValidator creates our validator, which reports fields by their JSON names and knows our own http_url tag
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	_ = v.RegisterValidation("http_url", isHTTPURL)
+	return v
+}
+
+// isHTTPURL checks a string field is an absolute http or https URL, unlike url which accepts any scheme
+func isHTTPURL(fl validator.FieldLevel) bool {
+	u, err := url.Parse(fl.Field().String())
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// DefaultBodyLimit is the number of bytes read from request bodies when no other limit is given
+const DefaultBodyLimit = 100000
+
+// ErrBodyTooLarge is returned when a request body is over the limit it is read with
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// ReadBody of a HTTP request up to limit bytes and make sure the Body is not consumed. ErrBodyTooLarge
+// is returned if the body is longer than limit.
 func ReadBody(r *http.Request, limit int64) ([]byte, error) {
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit))
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err == nil && int64(len(body)) > limit {
+		err = ErrBodyTooLarge
+	}
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
 	return body, err
 
@@ -24,9 +63,14 @@ func ReadBody(r *http.Request, limit int64) ([]byte, error) {
 // DecodeAndValidateJSON takes the passed in envelope and tries to unmarshal it from the body
 // of the passed in request, then validating it
 func DecodeAndValidateJSON(envelope interface{}, r *http.Request) error {
-	body, err := ReadBody(r, 100000)
+	return DecodeAndValidateJSONWithLimit(envelope, r, DefaultBodyLimit)
+}
+
+// DecodeAndValidateJSONWithLimit is like DecodeAndValidateJSON but reads at most limit bytes of the body
+func DecodeAndValidateJSONWithLimit(envelope interface{}, r *http.Request, limit int64) error {
+	body, err := ReadBody(r, limit)
 	if err != nil {
-		return fmt.Errorf("unable to read request body: %s", err)
+		return fmt.Errorf("unable to read request body: %w", err)
 	}
 
 	// try to decode our envelope
@@ -35,9 +79,9 @@ func DecodeAndValidateJSON(envelope interface{}, r *http.Request) error {
 	}
 
 	// check our input is valid
-	err = validate.Struct(envelope)
+	err = Validate(envelope)
 	if err != nil {
-		return fmt.Errorf("request JSON doesn't match required schema: %s", err)
+		return fmt.Errorf("request JSON doesn't match required schema: %w", err)
 	}
 
 	return nil
@@ -10,6 +10,12 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // RequestResponseStatus represents the status of a WebhookRequest
@@ -52,8 +58,32 @@ func MakeHTTPRequest(req *http.Request) (*RequestResponse, error) {
 }
 
 // MakeHTTPRequestWithClient makes an HTTP request with the passed in client, returning a
-// RequestResponse containing logging information gathered during the request
+// RequestResponse containing logging information gathered during the request. The request is traced as a
+// child of any span in its context and carries W3C trace context headers.
 func MakeHTTPRequestWithClient(req *http.Request, client *http.Client) (*RequestResponse, error) {
+	ctx, span := otel.Tracer(tracerName).Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.String()),
+		),
+	)
+	defer span.End()
+
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	rr, err := makeHTTPRequest(req, client)
+	if rr != nil && rr.StatusCode != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", rr.StatusCode))
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return rr, err
+}
+
+func makeHTTPRequest(req *http.Request, client *http.Client) (*RequestResponse, error) {
 	req.Header.Set("User-Agent", HTTPUserAgent)
 
 	start := time.Now()
@@ -193,4 +223,6 @@ var (
 	insecureOnce      sync.Once
 
 	HTTPUserAgent = "Courier/vDev"
+
+	tracerName = "github.com/greatnonprofits-nfp/websocket-go/utils"
 )
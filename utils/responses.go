@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	validator "gopkg.in/go-playground/validator.v9"
+)
+
+// ErrorResponse is the body of our JSON error responses
+type ErrorResponse struct {
+	Error   string   `json:"error"`
+	Details []string `json:"details,omitempty"`
+}
+
+// WriteJSONResponse writes the passed in value as JSON with the passed in status code
+func WriteJSONResponse(w http.ResponseWriter, statusCode int, value interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	return json.NewEncoder(w).Encode(value)
+}
+
+// WriteJSONError writes a JSON error response with the passed in status code and message, along with a
+// detail for each invalid field if the error came from validation
+func WriteJSONError(w http.ResponseWriter, statusCode int, message string, err error) error {
+	return WriteJSONResponse(w, statusCode, &ErrorResponse{Error: message, Details: ErrorDetails(err)})
+}
+
+// ErrorDetails describes the passed in error, with a detail for each invalid field if it came from validation
+func ErrorDetails(err error) []string {
+	if err == nil {
+		return nil
+	}
+
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return []string{err.Error()}
+	}
+
+	details := make([]string, 0, len(validationErrs))
+	for _, fieldErr := range validationErrs {
+		details = append(details, fmt.Sprintf("field '%s' failed validation '%s'", fieldErr.Field(), fieldErr.Tag()))
+	}
+	return details
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"strings"
+
 	"golang.org/x/text/language"
 )
 
@@ -15,4 +17,15 @@ func GetLanguage(s string) string {
 		return ""
 	}
 	return base.String()
-}
\ No newline at end of file
+}
+
+// SplitList splits a comma separated list from our config, trimming whitespace and dropping empty values
+func SplitList(s string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,409 @@
+package webchat
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/chilts/sid"
+	"github.com/go-chi/chi/middleware"
+	"github.com/greatnonprofits-nfp/websocket-go/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// the senders of messages in a conversation agents are told about
+const (
+	senderContact = "contact"
+	senderBot     = "bot"
+	senderAgent   = "agent"
+)
+
+// watchRequest asks the hub to start or stop sending an agent the messages in a conversation
+type watchRequest struct {
+	agent  *Client
+	urn    string
+	watch  bool
+	result chan error
+}
+
+// mirrorMessage is an event for the agents watching a conversation
+type mirrorMessage struct {
+	ctx   context.Context
+	urn   string
+	event interface{}
+}
+
+// handoffStore holds which conversations are being handled by an agent rather than courier, it is safe for
+// concurrent use
+type handoffStore struct {
+	mutex sync.RWMutex
+	byURN map[string]string // agent client ID by URN
+}
+
+func newHandoffStore() *handoffStore {
+	return &handoffStore{byURN: make(map[string]string)}
+}
+
+// start hands the conversation with the passed in URN to the passed in agent, returning false if another agent
+// is already handling it
+func (s *handoffStore) start(urn string, agentID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if holder, found := s.byURN[urn]; found && holder != agentID {
+		return false
+	}
+	s.byURN[urn] = agentID
+	return true
+}
+
+// end hands the conversation with the passed in URN back to courier, returning false if the passed in agent
+// wasn't handling it
+func (s *handoffStore) end(urn string, agentID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.byURN[urn] != agentID {
+		return false
+	}
+	delete(s.byURN, urn)
+	return true
+}
+
+// active returns whether an agent is handling the conversation with the passed in URN
+func (s *handoffStore) active(urn string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, found := s.byURN[urn]
+	return found
+}
+
+// release hands every conversation the passed in agent was handling back to courier, returning their URNs
+func (s *handoffStore) release(agentID string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	released := make([]string, 0)
+	for urn, holder := range s.byURN {
+		if holder == agentID {
+			delete(s.byURN, urn)
+			released = append(released, urn)
+		}
+	}
+	return released
+}
+
+// conversationEvent returns the event agents watching a conversation are sent a message in it as
+func conversationEvent(urn string, sender string, agent string, text string, msg interface{}) map[string]interface{} {
+	direction := "out"
+	if sender == senderContact {
+		direction = "in"
+	}
+	return map[string]interface{}{
+		"event": "conversationMessage",
+		"data": map[string]interface{}{
+			"urn":       urn,
+			"direction": direction,
+			"sender":    sender,
+			"agent":     agent,
+			"text":      text,
+			"message":   msg,
+		},
+	}
+}
+
+// handoffEvent returns the event agents watching a conversation are told it has started or stopped being
+// handled by an agent with
+func handoffEvent(urn string, active bool, agent string) map[string]interface{} {
+	return map[string]interface{}{
+		"event": "handoff",
+		"data": map[string]interface{}{
+			"urn":    urn,
+			"active": active,
+			"agent":  agent,
+		},
+	}
+}
+
+// mirrorToAgents sends the passed in event to the agents watching the conversation with the passed in URN
+func (h *Hub) mirrorToAgents(ctx context.Context, urn string, event interface{}) {
+	h.mirror <- &mirrorMessage{ctx: ctx, urn: urn, event: event}
+}
+
+// sendToWatchers sends the passed in event to the agents watching the passed in URN, it must only be called
+// from the hub goroutine
+func (h *Hub) sendToWatchers(ctx context.Context, urn string, event interface{}) {
+	for agent := range h.watchers[urn] {
+		agent.sendMessage(ctx, event)
+	}
+}
+
+// updateWatch applies the passed in watch request, it must only be called from the hub goroutine
+func (h *Hub) updateWatch(req *watchRequest) error {
+	if !req.watch {
+		delete(h.watchers[req.urn], req.agent)
+		if len(h.watchers[req.urn]) == 0 {
+			delete(h.watchers, req.urn)
+		}
+		return nil
+	}
+
+	if err := h.checkContactChannel(req.agent, req.urn); err != nil {
+		return err
+	}
+	if h.watchers[req.urn] == nil {
+		h.watchers[req.urn] = make(map[*Client]bool)
+	}
+	h.watchers[req.urn][req.agent] = true
+	return nil
+}
+
+// checkContactChannel returns an error unless the contact with the passed in URN is known to be of the passed in
+// agent's channel, as agents can only see and handle contacts of their own channel. Contacts are known by the
+// channel they last connected on until their presence is forgotten.
+func (h *Hub) checkContactChannel(agent *Client, urn string) error {
+	channelUUID := h.presence.channelOf(urn)
+	if channelUUID == "" {
+		return errors.New("conversation isn't known")
+	}
+	if channelUUID != agent.ChannelUUID {
+		return errors.New("conversation belongs to another channel")
+	}
+	return nil
+}
+
+// unregisterAgent stops sending the passed in agent anything and hands back the conversations it was handling,
+// it must only be called from the hub goroutine
+func (h *Hub) unregisterAgent(agent *Client) {
+	for urn, agents := range h.watchers {
+		delete(agents, agent)
+		if len(agents) == 0 {
+			delete(h.watchers, urn)
+		}
+	}
+	for _, urn := range h.handoffs.release(agent.Id) {
+		h.sendToWatchers(agent.ctx, urn, handoffEvent(urn, false, agent.agentName))
+	}
+}
+
+// checkAgentToken returns whether the passed in token lets an agent connect to the passed in channel, agents use
+// their channel's tokens if it defines any and our global ones otherwise
+func (h *Hub) checkAgentToken(channel *Channel, token string) bool {
+	tokens := utils.SplitList(h.Config().AgentTokens)
+	if channel != nil && len(channel.AgentTokens) > 0 {
+		tokens = channel.AgentTokens
+	}
+	if token == "" {
+		return false
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeAgentWS upgrades an agent's request to a websocket connection. Agents authenticate with one of our agent
+// tokens, as a bearer token or in the token query parameter as browsers can't set headers on websockets.
+func ServeAgentWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	requestID := middleware.GetReqID(r.Context())
+	channelUUID := r.URL.Query().Get("channelUUID")
+	name := r.URL.Query().Get("name")
+	log := hub.logger.WithFields(logrus.Fields{"comp": "agent", "request_id": requestID, "channel_uuid": channelUUID})
+
+	var channel *Channel
+	if hub.channels.Enabled() {
+		channel = hub.channels.Get(channelUUID)
+		if channel == nil {
+			log.Warnln("Rejected agent connection for unknown channel")
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+	}
+
+	token := r.URL.Query().Get("token")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	if !hub.checkAgentToken(channel, token) {
+		log.Warnln("Rejected agent connection with invalid token")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := hub.agents.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+
+	client := newClient(hub, conn, sid.IdBase64(), channelUUID, "", "", requestID)
+	client.setChannel(channel)
+	client.acceptLanguage = r.Header.Get("Accept-Language")
+	client.negotiateLanguage("")
+	client.agent = true
+	client.agentName = name
+	client.watching = make(map[string]bool)
+	client.addLogField("agent", name)
+	client.startSession(r)
+
+	go client.writePump()
+	go client.readPump()
+}
+
+type AgentWatchRequest struct {
+	URN string `json:"urn" validate:"required"`
+}
+
+type AgentSendMessageRequest struct {
+	URN         string      `json:"urn"  validate:"required"`
+	Text        string      `json:"text" validate:"required"`
+	Metadata    interface{} `json:"metadata"`
+	Attachments interface{} `json:"attachments"`
+}
+
+type AgentHandoffRequest struct {
+	URN    string `json:"urn" validate:"required"`
+	Active bool   `json:"active"`
+}
+
+// decodeAgentRequest decodes and validates the data of the passed in agent event
+func decodeAgentRequest(msg *WSMessage, reqData interface{}) error {
+	if err := json.Unmarshal(msg.Data, reqData); err != nil {
+		return err
+	}
+	if err := utils.Validate(reqData); err != nil {
+		return errors.New(strings.Join(utils.ErrorDetails(err), ", "))
+	}
+	return nil
+}
+
+// replyAgent answers an agent event with the passed in data
+func replyAgent(ctx context.Context, agent *Client, msg *WSMessage, data interface{}) error {
+	if msg.CID == 0 {
+		return nil
+	}
+	responseEncoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	agent.sendMessage(ctx, map[string]interface{}{
+		"rid":   msg.CID,
+		"error": string(responseEncoded),
+	})
+	return nil
+}
+
+func HandleAgentHandshake(ctx context.Context, agent *Client, msg *WSMessage) error {
+	agent.sendMessage(ctx, map[string]interface{}{
+		"rid": msg.CID,
+		"data": map[string]interface{}{
+			"id":              agent.Id,
+			"pingTimeout":     agent.hub.pingTimeout().Milliseconds(),
+			"isAuthenticated": true,
+		},
+	})
+	return nil
+}
+
+func HandleAgentWatch(ctx context.Context, agent *Client, msg *WSMessage, watch bool) error {
+	reqData := &AgentWatchRequest{}
+	if err := decodeAgentRequest(msg, reqData); err != nil {
+		return err
+	}
+
+	req := &watchRequest{agent: agent, urn: reqData.URN, watch: watch, result: make(chan error, 1)}
+	agent.hub.watch <- req
+	if err := <-req.result; err != nil {
+		return err
+	}
+
+	if watch {
+		agent.watching[reqData.URN] = true
+	} else {
+		delete(agent.watching, reqData.URN)
+	}
+	return replyAgent(ctx, agent, msg, map[string]interface{}{
+		"urn":      reqData.URN,
+		"watching": watch,
+		"handoff":  agent.hub.handoffs.active(reqData.URN),
+	})
+}
+
+func HandleAgentSendMessage(ctx context.Context, agent *Client, msg *WSMessage) error {
+	reqData := &AgentSendMessageRequest{}
+	if err := decodeAgentRequest(msg, reqData); err != nil {
+		return err
+	}
+	if !agent.watching[reqData.URN] {
+		return errors.New("agents must watch a conversation before sending to it")
+	}
+	if err := agent.hub.checkContactChannel(agent, reqData.URN); err != nil {
+		return err
+	}
+
+	// agents speak as the bot, so the contact sees their messages like any other from courier
+	payload := &newMsgPayload{
+		ID:          "agent-" + sid.IdBase64(),
+		Text:        reqData.Text,
+		To:          reqData.URN,
+		Channel:     agent.ChannelUUID,
+		Metadata:    reqData.Metadata,
+		Attachments: reqData.Attachments,
+		agent:       agent.agentName,
+	}
+	status, err := agent.hub.Deliver(ctx, reqData.URN, payload)
+	if err != nil {
+		return err
+	}
+	if status.reached() {
+		agent.hub.recordHistory(reqData.URN, payload.historyMessage())
+	}
+	return replyAgent(ctx, agent, msg, map[string]string{"id": payload.ID, "status": routeStatuses[status]})
+}
+
+func HandleAgentHandoff(ctx context.Context, agent *Client, msg *WSMessage) error {
+	reqData := &AgentHandoffRequest{}
+	if err := decodeAgentRequest(msg, reqData); err != nil {
+		return err
+	}
+	if !agent.watching[reqData.URN] {
+		return errors.New("agents must watch a conversation before handling it")
+	}
+	if err := agent.hub.checkContactChannel(agent, reqData.URN); err != nil {
+		return err
+	}
+
+	if reqData.Active {
+		if !agent.hub.handoffs.start(reqData.URN, agent.Id) {
+			return errors.New("conversation is already handled by another agent")
+		}
+	} else if !agent.hub.handoffs.end(reqData.URN, agent.Id) {
+		return errors.New("conversation isn't handled by this agent")
+	}
+	agent.Log().WithField("urn", reqData.URN).WithField("active", reqData.Active).Infoln("Conversation handoff changed")
+
+	agent.hub.mirrorToAgents(ctx, reqData.URN, handoffEvent(reqData.URN, reqData.Active, agent.agentName))
+	return replyAgent(ctx, agent, msg, map[string]interface{}{"urn": reqData.URN, "active": reqData.Active})
+}
+
+func HandleAgentMessage(ctx context.Context, agent *Client, msg *WSMessage) (error, string) {
+	if msg.Event == "#handshake" {
+		return HandleAgentHandshake(ctx, agent, msg), "Failed to send handshake response message:"
+	} else if msg.Event == "watch" {
+		return HandleAgentWatch(ctx, agent, msg, true), "Failed to watch conversation:"
+	} else if msg.Event == "unwatch" {
+		return HandleAgentWatch(ctx, agent, msg, false), "Failed to unwatch conversation:"
+	} else if msg.Event == "sendMessage" {
+		return HandleAgentSendMessage(ctx, agent, msg), "Failed to send message:"
+	} else if msg.Event == "handoff" {
+		return HandleAgentHandoff(ctx, agent, msg), "Failed to change handoff:"
+	}
+	return nil, ""
+}
@@ -0,0 +1,54 @@
+package webchat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	server "github.com/greatnonprofits-nfp/websocket-go"
+)
+
+func TestAgentOrigins(t *testing.T) {
+	tcs := []struct {
+		label        string
+		agentOrigins string
+		path         string
+		origin       string
+		expectedCode int
+	}{
+		{"widget from channel origin", "", "/socketcluster", "https://widget.example", 101},
+		{"widget from other origin", "", "/socketcluster", "https://console.example", 403},
+		{"agent from any origin", "", "/agent", "https://console.example", 101},
+		{"agent from allowed origin", "https://console.example", "/agent", "https://console.example", 101},
+		{"agent from other origin", "https://console.example", "/agent", "https://widget.example", 403},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.label, func(t *testing.T) {
+			hub := newTestChannelsHub(t, `[
+				{"uuid": "`+testChannelA+`", "courier_url": "http://courier.invalid", "agent_tokens": ["sekret"], "allowed_origins": ["https://widget.example"]}
+			]`, func(config *server.Config) { config.AgentAllowedOrigins = tc.agentOrigins })
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/agent" {
+					ServeAgentWS(hub, w, r)
+				} else {
+					ServeWS(hub, w, r)
+				}
+			}))
+			defer srv.Close()
+
+			url := "ws" + strings.TrimPrefix(srv.URL, "http") + tc.path + "?channelUUID=" + testChannelA + "&token=sekret"
+			conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {tc.origin}})
+			if conn != nil {
+				conn.Close()
+			}
+			if resp == nil || resp.StatusCode != tc.expectedCode {
+				t.Errorf("expected %d, got %v %v", tc.expectedCode, resp, err)
+			}
+		})
+	}
+}
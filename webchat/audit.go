@@ -0,0 +1,148 @@
+package webchat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	server "github.com/greatnonprofits-nfp/websocket-go"
+	"github.com/greatnonprofits-nfp/websocket-go/utils"
+)
+
+// AuditEntry is the record of a single exchange with courier made on behalf of a client
+type AuditEntry struct {
+	Time        time.Time                   `json:"time"`
+	ClientID    string                      `json:"client_id"`
+	ChannelUUID string                      `json:"channel_uuid"`
+	URN         string                      `json:"urn,omitempty"`
+	RequestID   string                      `json:"request_id,omitempty"`
+	Method      string                      `json:"method"`
+	URL         string                      `json:"url"`
+	Status      utils.RequestResponseStatus `json:"status"`
+	StatusCode  int                         `json:"status_code"`
+	ElapsedMS   int64                       `json:"elapsed_ms"`
+	Request     string                      `json:"request"`
+	Response    string                      `json:"response"`
+}
+
+// AuditSink is something courier exchanges can be recorded to, implementations must be safe for concurrent use
+type AuditSink interface {
+	Record(entry *AuditEntry) error
+	Close() error
+}
+
+// jsonLinesSink writes each entry as a single line of JSON
+type jsonLinesSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	closer io.Closer
+}
+
+// NewJSONLinesAuditSink creates a sink which writes entries as JSON lines to the passed in writer
+func NewJSONLinesAuditSink(writer io.Writer) AuditSink {
+	return &jsonLinesSink{writer: writer}
+}
+
+// NewStdoutAuditSink creates a sink which writes entries as JSON lines to stdout
+func NewStdoutAuditSink() AuditSink {
+	return NewJSONLinesAuditSink(os.Stdout)
+}
+
+// NewFileAuditSink creates a sink which appends entries as JSON lines to the passed in file
+func NewFileAuditSink(filename string) (AuditSink, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit file: %s", err)
+	}
+	return &jsonLinesSink{writer: file, closer: file}, nil
+}
+
+func (s *jsonLinesSink) Record(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.writer.Write(append(line, '\n'))
+	return err
+}
+
+func (s *jsonLinesSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// NewAuditSink creates the audit sink described by our config, returning nil if auditing is disabled
+func NewAuditSink(config *server.Config) (AuditSink, error) {
+	switch config.AuditSink {
+	case "":
+		return nil, nil
+	case "stdout":
+		return NewStdoutAuditSink(), nil
+	case "file":
+		return NewFileAuditSink(config.AuditFile)
+	}
+	return nil, fmt.Errorf("unknown audit sink: %s", config.AuditSink)
+}
+
+// tokenRegex matches the values of tokens in JSON bodies and authorization headers
+var tokenRegex = regexp.MustCompile(`(?i)("[a-z_]*token"\s*:\s*")[^"]*(")|(authorization:\s*)[^\r\n]*()`)
+
+// redactTokens replaces any tokens in the passed in trace so they aren't written to our audit log
+func redactTokens(trace string) string {
+	return tokenRegex.ReplaceAllString(trace, "${1}${3}********${2}${4}")
+}
+
+// truncate cuts the passed in trace down to max bytes, 0 meaning no limit
+func truncate(trace string, max int) string {
+	if max <= 0 || len(trace) <= max {
+		return trace
+	}
+	return trace[:max] + "...(truncated)"
+}
+
+// audit records the passed in courier exchange made by the client to our audit sink if we have one. Failed
+// exchanges are always recorded, successful ones are sampled according to our config.
+func (h *Hub) audit(client *Client, rr *utils.RequestResponse) {
+	if h.auditSink == nil || rr == nil {
+		return
+	}
+
+	config := h.Config()
+	if rr.Status == utils.RRStatusSuccess && rand.Float64() >= config.AuditSampleRate {
+		return
+	}
+
+	entry := &AuditEntry{
+		Time:        time.Now().UTC(),
+		ClientID:    client.Id,
+		ChannelUUID: client.ChannelUUID,
+		URN:         client.UserUrn,
+		RequestID:   client.RequestID,
+		Method:      rr.Method,
+		URL:         rr.URL,
+		Status:      rr.Status,
+		StatusCode:  rr.StatusCode,
+		ElapsedMS:   rr.Elapsed.Milliseconds(),
+		Request:     truncate(redactTokens(rr.Request), config.AuditMaxTraceSize),
+		Response:    truncate(redactTokens(rr.Response), config.AuditMaxTraceSize),
+	}
+
+	// connection failures have no response, but the error is put in the body
+	if rr.Status == utils.RRConnectionFailure {
+		entry.Response = string(rr.Body)
+	}
+
+	if err := h.auditSink.Record(entry); err != nil {
+		client.Log().Errorln("Failed to record audit entry:", err)
+	}
+}
@@ -0,0 +1,208 @@
+package webchat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/greatnonprofits-nfp/websocket-go/utils"
+)
+
+const (
+	signatureHeader = "X-Signature"
+	timestampHeader = "X-Timestamp"
+)
+
+// courierChannelKey is the context key of the channel a courier request authenticated as
+type courierChannelKey struct{}
+
+// courierSecrets are the shared secrets requests from courier may be authenticated with, and the channel they
+// are the secrets of, empty for our global ones
+type courierSecrets struct {
+	channelUUID string
+	token       string
+	hmacSecret  string
+}
+
+// hasSecrets returns whether the passed in channel defines its own courier secrets
+func (c *Channel) hasSecrets() bool {
+	return c != nil && (c.AuthToken != "" || c.HMACSecret != "")
+}
+
+// courierSecretsFor returns the secrets courier must use for requests about the passed in channel, which are
+// the channel's own if it defines any
+func (h *Hub) courierSecretsFor(channelUUID string) courierSecrets {
+	if channel := h.channels.Get(channelUUID); channel.hasSecrets() {
+		return courierSecrets{channelUUID: channel.UUID, token: channel.AuthToken, hmacSecret: channel.HMACSecret}
+	}
+	config := h.Config()
+	return courierSecrets{token: config.CourierAuthToken, hmacSecret: config.CourierHMACSecret}
+}
+
+// courierChannel returns the channel the courier request with the passed in context authenticated as, empty if it
+// used our global secrets or none
+func courierChannel(ctx context.Context) string {
+	channelUUID, _ := ctx.Value(courierChannelKey{}).(string)
+	return channelUUID
+}
+
+// checkCourierTarget returns an error unless the courier request with the passed in context may reach the contact
+// with the passed in URN. Requests authenticated as a channel can only reach that channel's contacts, and contacts
+// of channels with their own secrets can only be reached by requests authenticated with them. A contact's channel
+// is the one it last connected on, which presence records whenever a client subscribes or resumes.
+func (h *Hub) checkCourierTarget(ctx context.Context, urn string) error {
+	target := h.presence.channelOf(urn)
+	if authenticated := courierChannel(ctx); authenticated != "" {
+		if target != "" && target != authenticated {
+			return errors.New("contact belongs to another channel")
+		}
+		return nil
+	}
+	if h.channels.Get(target).hasSecrets() {
+		return errors.New("contact's channel requires its own credentials")
+	}
+	return nil
+}
+
+// courierAuthRequired returns whether requests from courier must be authenticated, which they must be as soon as
+// any secret is configured, globally or for any channel
+func (h *Hub) courierAuthRequired() bool {
+	config := h.Config()
+	return config.CourierAuthToken != "" || config.CourierHMACSecret != "" || h.channels.Secured()
+}
+
+// replayCache remembers the signatures we have accepted so the same signed request can't be sent twice
+type replayCache struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+// add records the passed in signature until it expires, returning false if it has already been seen
+func (c *replayCache) add(signature string, expires time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for s, e := range c.seen {
+		if e.Before(now) {
+			delete(c.seen, s)
+		}
+	}
+
+	if _, found := c.seen[signature]; found {
+		return false
+	}
+	c.seen[signature] = expires
+	return true
+}
+
+// CourierAuth creates middleware which checks requests from courier carry our shared secret, either as a bearer
+// token or as an HMAC-SHA256 signature over the timestamp and body. Requests without credentials get a 401,
+// those with invalid credentials a 403. The secrets are those of the channel the request names if it has its own,
+// otherwise our global ones. Requests are only let through unauthenticated if no secrets are configured at all,
+// so a request naming no channel, such as a batch or presence query, or a channel without secrets is rejected
+// when only channels have secrets. Requests authenticated with a channel's secrets carry it in their context so
+// handlers can check what they reach with checkCourierTarget.
+func CourierAuth(hub *Hub) func(http.Handler) http.Handler {
+	replays := &replayCache{seen: make(map[string]time.Time)}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := hub.logger.WithField("comp", "courier_auth").WithField("request_id", middleware.GetReqID(r.Context()))
+
+			// batches are our largest requests, handlers enforce their own tighter limits
+			body, err := utils.ReadBody(r, hub.Config().BatchMaxBodySize)
+			if err != nil {
+				writeBodyError(w, "unable to read request body", err)
+				return
+			}
+
+			// secrets can be configured per channel, so peek at which channel this is for
+			envelope := &struct {
+				Channel string `json:"channel"`
+			}{}
+			_ = json.Unmarshal(body, envelope)
+			secrets := hub.courierSecretsFor(envelope.Channel)
+
+			if secrets.token == "" && secrets.hmacSecret == "" {
+				if !hub.courierAuthRequired() {
+					next.ServeHTTP(w, r)
+					return
+				}
+				log.WithField("channel", envelope.Channel).Warn("rejected request for which no secrets are configured")
+				_ = utils.WriteJSONError(w, http.StatusForbidden, "invalid credentials", nil)
+				return
+			}
+
+			authorization := r.Header.Get("Authorization")
+			signature := r.Header.Get(signatureHeader)
+
+			switch {
+			case secrets.token != "" && strings.HasPrefix(authorization, "Bearer "):
+				token := strings.TrimPrefix(authorization, "Bearer ")
+				if subtle.ConstantTimeCompare([]byte(token), []byte(secrets.token)) != 1 {
+					log.Warn("rejected request with invalid bearer token")
+					_ = utils.WriteJSONError(w, http.StatusForbidden, "invalid credentials", nil)
+					return
+				}
+
+			case secrets.hmacSecret != "" && signature != "":
+				maxSkew := time.Duration(hub.Config().CourierHMACMaxSkew) * time.Second
+				timestamp, err := strconv.ParseInt(r.Header.Get(timestampHeader), 10, 64)
+				if err != nil {
+					log.Warn("rejected signed request without valid timestamp")
+					_ = utils.WriteJSONError(w, http.StatusUnauthorized, "missing or invalid timestamp", nil)
+					return
+				}
+				signedAt := time.Unix(timestamp, 0)
+				if time.Since(signedAt) > maxSkew || time.Until(signedAt) > maxSkew {
+					log.WithField("timestamp", timestamp).Warn("rejected signed request with stale timestamp")
+					_ = utils.WriteJSONError(w, http.StatusForbidden, "invalid credentials", nil)
+					return
+				}
+
+				expected := signBody(secrets.hmacSecret, timestamp, body)
+				signature = strings.TrimPrefix(signature, "sha256=")
+				if !hmac.Equal([]byte(signature), []byte(expected)) {
+					log.Warn("rejected request with invalid signature")
+					_ = utils.WriteJSONError(w, http.StatusForbidden, "invalid credentials", nil)
+					return
+				}
+				if !replays.add(signature, signedAt.Add(maxSkew)) {
+					log.Warn("rejected replayed signed request")
+					_ = utils.WriteJSONError(w, http.StatusForbidden, "invalid credentials", nil)
+					return
+				}
+
+			default:
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chatbot-server"`)
+				_ = utils.WriteJSONError(w, http.StatusUnauthorized, "missing credentials", nil)
+				return
+			}
+
+			if secrets.channelUUID != "" {
+				r = r.WithContext(context.WithValue(r.Context(), courierChannelKey{}, secrets.channelUUID))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// signBody returns the hex encoded HMAC-SHA256 signature of the passed in timestamp and body
+func signBody(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
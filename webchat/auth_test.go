@@ -0,0 +1,225 @@
+package webchat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/greatnonprofits-nfp/websocket-go"
+)
+
+const (
+	testChannelA = "a0000000-5ecb-45ba-b726-3b064e0c56ab"
+	testChannelB = "b0000000-5ecb-45ba-b726-3b064e0c56ab"
+	testChannelC = "c0000000-5ecb-45ba-b726-3b064e0c56ab"
+)
+
+// newTestChannelsHub starts a hub with the passed in channel definitions, changing its config with the passed in
+// function if any
+func newTestChannelsHub(t *testing.T, channels string, configure func(*server.Config)) *Hub {
+	path := filepath.Join(t.TempDir(), "channels.json")
+	if err := os.WriteFile(path, []byte(channels), 0600); err != nil {
+		t.Fatalf("error writing channels: %s", err)
+	}
+	hub := newTestHub(t, func(config *server.Config) {
+		config.ChannelsFile = path
+		if configure != nil {
+			configure(config)
+		}
+	})
+	if err := hub.Channels().Load(); err != nil {
+		t.Fatalf("error loading channels: %s", err)
+	}
+	return hub
+}
+
+// serveCourierRoutes serves our courier routes for the passed in hub behind CourierAuth, like main does
+func serveCourierRoutes(hub *Hub) http.Handler {
+	auth := CourierAuth(hub)
+	mux := http.NewServeMux()
+	mux.Handle("/", auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { MessageReceived(hub, w, r) })))
+	mux.Handle("/batch", auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { BatchMessagesReceived(hub, w, r) })))
+	mux.Handle("/event", auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { EventReceived(hub, w, r) })))
+	return mux
+}
+
+// postCourier posts the passed in body to the passed in path with the passed in headers, returning the response
+func postCourier(handler http.Handler, path string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// bearer returns the headers of a request authenticated with the passed in bearer token
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func TestCourierTarget(t *testing.T) {
+	hub := newTestChannelsHub(t, `[
+		{"uuid": "`+testChannelA+`", "courier_url": "http://courier.invalid", "auth_token": "a-secret"},
+		{"uuid": "`+testChannelB+`", "courier_url": "http://courier.invalid", "auth_token": "b-secret"},
+		{"uuid": "`+testChannelC+`", "courier_url": "http://courier.invalid"}
+	]`, func(config *server.Config) { config.CourierAuthToken = "global" })
+
+	for urn, channelUUID := range map[string]string{"webchat:a": testChannelA, "webchat:b": testChannelB, "webchat:c": testChannelC} {
+		widget := connectWidget(t, hub, channelUUID, "")
+		widget.handshake(`{}`)
+		widget.subscribe(hub, urn)
+	}
+	handler := serveCourierRoutes(hub)
+
+	tcs := []struct {
+		label   string
+		path    string
+		token   string
+		channel string
+		to      string
+		code    int
+	}{
+		{"own contact", "/", "a-secret", testChannelA, "webchat:a", 202},
+		{"other secured channel's contact", "/", "a-secret", testChannelA, "webchat:b", 403},
+		{"unsecured channel's contact", "/", "a-secret", testChannelA, "webchat:c", 403},
+		{"unknown contact", "/", "a-secret", testChannelA, "webchat:nobody", 404},
+		{"global secret for secured channel's contact", "/", "global", "", "webchat:a", 403},
+		{"global secret naming unsecured channel for secured contact", "/", "global", testChannelC, "webchat:a", 403},
+		{"global secret for unsecured channel's contact", "/", "global", testChannelC, "webchat:c", 202},
+		{"global secret for unknown contact", "/", "global", "", "webchat:nobody", 404},
+		{"event for own contact", "/event", "a-secret", testChannelA, "webchat:a", 202},
+		{"event for other channel's contact", "/event", "a-secret", testChannelA, "webchat:b", 403},
+		{"event with global secret for secured contact", "/event", "global", "", "webchat:b", 403},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.label, func(t *testing.T) {
+			body := map[string]interface{}{"id": "1", "to": tc.to, "channel": tc.channel, "text": "hi"}
+			if tc.path == "/event" {
+				body = map[string]interface{}{"id": "1", "to": tc.to, "channel": tc.channel, "event": "conversation_closed"}
+			}
+			encoded, _ := json.Marshal(body)
+
+			w := postCourier(handler, tc.path, string(encoded), bearer(tc.token))
+			if w.Code != tc.code {
+				t.Errorf("expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// batches are authenticated with our global secrets so can only reach contacts of unsecured channels
+	w := postCourier(handler, "/batch", `[{"id":"1","to":"webchat:c","text":"hi"},{"id":"2","to":"webchat:a","text":"hi"}]`, bearer("global"))
+	response := &batchReceivedResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), response); err != nil || w.Code != 200 || len(response.Results) != 2 {
+		t.Fatalf("unexpected batch response %d: %s", w.Code, w.Body.String())
+	}
+	if response.Results[0].Status != msgStatusQueued || response.Results[1].Status != msgStatusForbidden {
+		t.Errorf("expected queued and forbidden, got %s and %s", response.Results[0].Status, response.Results[1].Status)
+	}
+}
+
+// signed returns the headers of a request with the passed in body signed with the passed in secret at the passed
+// in time
+func signed(secret string, at time.Time, body string) map[string]string {
+	timestamp := at.Unix()
+	return map[string]string{
+		signatureHeader: "sha256=" + signBody(secret, timestamp, []byte(body)),
+		timestampHeader: strconv.FormatInt(timestamp, 10),
+	}
+}
+
+func TestCourierAuth(t *testing.T) {
+	hub := newTestChannelsHub(t, `[
+		{"uuid": "`+testChannelA+`", "courier_url": "http://courier.invalid", "auth_token": "a-secret"},
+		{"uuid": "`+testChannelB+`", "courier_url": "http://courier.invalid", "hmac_secret": "b-hmac"},
+		{"uuid": "`+testChannelC+`", "courier_url": "http://courier.invalid"}
+	]`, func(config *server.Config) {
+		config.CourierAuthToken = "global"
+		config.CourierHMACSecret = "g-hmac"
+		config.CourierHMACMaxSkew = 60
+	})
+
+	// the handler behind our middleware reports which channel the request authenticated as
+	handler := CourierAuth(hub)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(courierChannel(r.Context())))
+	}))
+
+	now := time.Now()
+	noChannel := `{"id":"1","to":"webchat:1234","text":"hi"}`
+	channelA := `{"id":"1","to":"webchat:1234","channel":"` + testChannelA + `","text":"hi"}`
+	channelB := `{"id":"1","to":"webchat:1234","channel":"` + testChannelB + `","text":"hi"}`
+	channelC := `{"id":"1","to":"webchat:1234","channel":"` + testChannelC + `","text":"hi"}`
+	replayed := signed("g-hmac", now, noChannel)
+
+	tcs := []struct {
+		label   string
+		body    string
+		headers map[string]string
+		code    int
+		channel string
+	}{
+		{"no credentials", noChannel, nil, 401, ""},
+		{"unknown scheme", noChannel, map[string]string{"Authorization": "Basic Zm9vOmJhcg=="}, 401, ""},
+		{"global bearer", noChannel, bearer("global"), 200, ""},
+		{"wrong bearer", noChannel, bearer("nope"), 403, ""},
+		{"global signature", noChannel, replayed, 200, ""},
+		{"replayed signature", noChannel, replayed, 403, ""},
+		{"signature over other body", channelC, signed("g-hmac", now, noChannel), 403, ""},
+		{"wrong signing secret", noChannel, signed("nope", now, noChannel), 403, ""},
+		{"stale signature", noChannel, signed("g-hmac", now.Add(-2*time.Minute), noChannel), 403, ""},
+		{"future signature", noChannel, signed("g-hmac", now.Add(2*time.Minute), noChannel), 403, ""},
+		{"signature within skew", noChannel, signed("g-hmac", now.Add(-30*time.Second), noChannel), 200, ""},
+		{"missing timestamp", noChannel, map[string]string{signatureHeader: signed("g-hmac", now, noChannel)[signatureHeader]}, 401, ""},
+		{"invalid timestamp", noChannel, map[string]string{signatureHeader: "sha256=abc", timestampHeader: "yesterday"}, 401, ""},
+		{"channel's own bearer", channelA, bearer("a-secret"), 200, testChannelA},
+		{"global bearer for channel with own secrets", channelA, bearer("global"), 403, ""},
+		{"channel's bearer for another channel", channelC, bearer("a-secret"), 403, ""},
+		{"channel's own signature", channelB, signed("b-hmac", now, channelB), 200, testChannelB},
+		{"global signature for channel with own secrets", channelB, signed("g-hmac", now, channelB), 403, ""},
+		{"bearer for channel with only HMAC secret", channelB, bearer("global"), 401, ""},
+		{"global bearer for channel without own secrets", channelC, bearer("global"), 200, ""},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.label, func(t *testing.T) {
+			w := postCourier(handler, "/", tc.body, tc.headers)
+			if w.Code != tc.code {
+				t.Fatalf("expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+			if w.Code == 200 && w.Body.String() != tc.channel {
+				t.Errorf("expected request to authenticate as %q, got %q", tc.channel, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCourierAuthSecretsRequired(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	body := `{"id":"1","to":"webchat:1234","text":"hi"}`
+
+	// requests are let through when nothing has secrets
+	hub := newTestChannelsHub(t, `[{"uuid": "`+testChannelA+`", "courier_url": "http://courier.invalid"}]`, nil)
+	if w := postCourier(CourierAuth(hub)(ok), "/", body, nil); w.Code != 200 {
+		t.Errorf("expected unauthenticated request to pass without secrets, got %d", w.Code)
+	}
+
+	// but once any channel has secrets, requests which can't be checked against any are rejected
+	hub = newTestChannelsHub(t, `[
+		{"uuid": "`+testChannelA+`", "courier_url": "http://courier.invalid", "auth_token": "a-secret"},
+		{"uuid": "`+testChannelC+`", "courier_url": "http://courier.invalid"}
+	]`, nil)
+	for _, body := range []string{body, `{"id":"1","to":"webchat:1234","channel":"` + testChannelC + `","text":"hi"}`} {
+		if w := postCourier(CourierAuth(hub)(ok), "/", body, bearer("a-secret")); w.Code != 403 {
+			t.Errorf("expected 403 for request without secrets to check, got %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package webchat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/greatnonprofits-nfp/websocket-go/utils"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
+)
+
+// the features channels can toggle, all of them are enabled unless a channel turns them off
+const (
+	FeatureHistory       = "history"
+	FeatureOutbox        = "outbox"
+	FeatureSessionResume = "session_resume"
+)
+
+// Channel is the server side definition of a webchat channel
+type Channel struct {
+	UUID           string          `json:"uuid"             validate:"required"`
+	CourierURL     string          `json:"courier_url"      validate:"required,url"`
+	AuthToken      string          `json:"auth_token"`
+	HMACSecret     string          `json:"hmac_secret"`
+	AgentTokens    []string        `json:"agent_tokens"`
+	AllowedOrigins []string        `json:"allowed_origins"`
+	RateLimit      int             `json:"rate_limit"       validate:"min=0"`
+	Language       string          `json:"language"`
+	WelcomeMessage string          `json:"welcome_message"`
+	Trigger        *ChannelTrigger `json:"trigger"`
+	Features       map[string]bool `json:"features"`
+}
+
+// FeatureEnabled returns whether the passed in feature is enabled for this channel
+func (c *Channel) FeatureEnabled(feature string) bool {
+	enabled, found := c.Features[feature]
+	return !found || enabled
+}
+
+// ChannelRegistry holds our channel definitions, read from the file or admin API in our config. When neither is
+// configured it is disabled and channels are defined by the query strings of websocket clients as before.
+type ChannelRegistry struct {
+	hub      *Hub
+	logger   *logrus.Entry
+	channels atomic.Value // map[string]*Channel
+	enabled  atomic.Value // bool
+	secured  atomic.Value // bool
+}
+
+func newChannelRegistry(hub *Hub) *ChannelRegistry {
+	r := &ChannelRegistry{hub: hub, logger: hub.logger.WithField("comp", "channels")}
+	r.channels.Store(map[string]*Channel{})
+	r.enabled.Store(false)
+	r.secured.Store(false)
+	return r
+}
+
+// Enabled returns whether channels must be defined in this registry
+func (r *ChannelRegistry) Enabled() bool {
+	return r.enabled.Load().(bool)
+}
+
+// Secured returns whether any of our channels defines its own courier secrets
+func (r *ChannelRegistry) Secured() bool {
+	return r.secured.Load().(bool)
+}
+
+// Get returns the channel with the passed in UUID, or nil if there is no such channel
+func (r *ChannelRegistry) Get(uuid string) *Channel {
+	return r.channels.Load().(map[string]*Channel)[uuid]
+}
+
+// Load reads our channel definitions from the source in our config, keeping the ones we have if they can't be read
+func (r *ChannelRegistry) Load() error {
+	config := r.hub.Config()
+
+	var data []byte
+	var err error
+	switch {
+	case config.ChannelsFile != "":
+		data, err = os.ReadFile(config.ChannelsFile)
+	case config.ChannelsURL != "":
+		data, err = r.fetch(config.ChannelsURL, config.ChannelsAPIToken)
+	default:
+		r.enabled.Store(false)
+		r.secured.Store(false)
+		r.channels.Store(map[string]*Channel{})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading channels: %w", err)
+	}
+
+	defs := make([]*Channel, 0)
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return fmt.Errorf("error parsing channels: %w", err)
+	}
+
+	channels := make(map[string]*Channel, len(defs))
+	secured := false
+	for i, channel := range defs {
+		if channel == nil {
+			return fmt.Errorf("channel %d can't be null", i)
+		}
+		if err := utils.Validate(channel); err != nil {
+			return fmt.Errorf("invalid channel %d: %s", i, strings.Join(utils.ErrorDetails(err), ", "))
+		}
+		if _, err := language.Parse(channel.Language); channel.Language != "" && err != nil {
+			return fmt.Errorf("invalid channel %d: language %s isn't valid", i, channel.Language)
+		}
+		if _, found := channels[channel.UUID]; found {
+			return fmt.Errorf("channel %s is defined more than once", channel.UUID)
+		}
+		channels[channel.UUID] = channel
+		secured = secured || channel.hasSecrets()
+	}
+
+	r.channels.Store(channels)
+	r.enabled.Store(true)
+	r.secured.Store(secured)
+	r.logger.WithField("channels", len(channels)).Info("loaded channels")
+	return nil
+}
+
+// fetch reads our channel definitions from the passed in admin API URL
+func (r *ChannelRegistry) fetch(url string, token string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr, err := utils.MakeHTTPRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return rr.Body, nil
+}
+
+// Start reloads our channel definitions every refresh interval until the passed in stop channel is closed
+func (r *ChannelRegistry) Start(waitGroup *sync.WaitGroup, stop chan bool) {
+	interval := time.Duration(r.hub.Config().ChannelsRefreshInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Load(); err != nil {
+					r.logger.WithError(err).Error("error refreshing channels, keeping current ones")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
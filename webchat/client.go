@@ -1,94 +1,465 @@
 package webchat
 
 import (
+	"context"
 	"encoding/json"
-	"github.com/gorilla/websocket"
-	"github.com/sirupsen/logrus"
+	"errors"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/text/language"
+)
+
+const (
+	// closePongTimeout is the SocketCluster close code for a client that stopped answering our pings
+	closePongTimeout = 4001
 )
 
 var (
-	pingPeriod = 10 * time.Second
-	wsUpgrader = websocket.Upgrader{
-		ReadBufferSize:   1024,
-		WriteBufferSize:  1024,
-		HandshakeTimeout: 8 * time.Second,
-		CheckOrigin:      func(r *http.Request) bool { return true },
-	}
+	writeWait = 10 * time.Second
+	tracer    = otel.Tracer("github.com/greatnonprofits-nfp/websocket-go/webchat")
 )
 
+// outboundMessage is a message waiting to be written to a client, along with the context it was sent from
+type outboundMessage struct {
+	ctx context.Context
+	msg interface{}
+}
+
 type Client struct {
 	Id          string
 	ChannelUUID string
 	HostApi     string
 	UserUrn     string
 	UserToken   string
+	RequestID   string
 	Connection  *websocket.Conn
 
 	hub  *Hub
-	send chan interface{}
+	send chan *outboundMessage
+
+	// the context and span covering the whole websocket session
+	ctx     context.Context
+	session trace.Span
+
+	logMutex sync.RWMutex
+	log      *logrus.Entry
+
+	// the format messages from courier are sent in, set at handshake
+	outboundFormat atomic.Value
+
+	// the language server generated text is sent to this client in, negotiated from its Accept-Language header,
+	// the language it registers with and its channel's default
+	acceptLanguage string
+	language       atomic.Value
+
+	// the token this client can resume its session with after reconnecting, set at handshake
+	sessionToken string
+
+	// the URN courier registered this client's user token as, which unlike the URN it subscribes to is tied to
+	// its token, so is what its history is kept under
+	contactURN string
+
+	// our definition of the client's channel, nil if channels aren't defined on our side
+	channel *Channel
+	limiter *eventLimiter
+
+	// set for agents, along with the conversations they watch which is only used from the read pump
+	agent     bool
+	agentName string
+	watching  map[string]bool
+
+	invalidMessages int
+}
+
+// newClient creates a new client for the passed in connection, with a logger carrying its identity
+func newClient(hub *Hub, conn *websocket.Conn, id string, channelUUID string, hostApi string, userToken string, requestID string) *Client {
+	return &Client{
+		Id:          id,
+		ChannelUUID: channelUUID,
+		HostApi:     hostApi,
+		UserToken:   userToken,
+		RequestID:   requestID,
+		Connection:  conn,
+		hub:         hub,
+		send:        make(chan *outboundMessage),
+		ctx:         context.Background(),
+		session:     trace.SpanFromContext(context.Background()),
+		log: hub.logger.WithFields(logrus.Fields{
+			"comp":         "client",
+			"client_id":    id,
+			"channel_uuid": channelUUID,
+			"request_id":   requestID,
+		}),
+	}
+}
+
+// newDetachedClient creates a client with no connection, for making courier requests on behalf of a client which
+// may have since disconnected, such as when retrying its messages or reporting its presence. Nothing can be sent
+// to it.
+func newDetachedClient(hub *Hub, id string, channelUUID string, hostApi string, urn string, requestID string) *Client {
+	client := newClient(hub, nil, id, channelUUID, hostApi, "", requestID)
+	client.UserUrn = urn
+	return client
+}
+
+// startSession starts the span covering the session of this client, continuing any trace in the headers of
+// the upgrade request. It isn't derived from the request context as the session outlives the request.
+func (c *Client) startSession(r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+	c.ctx, c.session = tracer.Start(ctx, "webchat.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("webchat.client_id", c.Id),
+			attribute.String("webchat.channel_uuid", c.ChannelUUID),
+			attribute.String("webchat.request_id", c.RequestID),
+		),
+	)
+}
+
+// OutboundFormat returns the format messages from courier are sent to this client in
+func (c *Client) OutboundFormat() string {
+	if format, ok := c.outboundFormat.Load().(string); ok {
+		return format
+	}
+	return c.hub.Config().WSOutboundFormat
+}
+
+// setOutboundFormat sets the format messages from courier are sent to this client in
+func (c *Client) setOutboundFormat(format string) {
+	c.outboundFormat.Store(format)
+}
+
+// Language returns the language server generated text is sent to this client in
+func (c *Client) Language() language.Tag {
+	if tag, ok := c.language.Load().(language.Tag); ok {
+		return tag
+	}
+	return language.English
+}
+
+// negotiateLanguage picks the language of this client from the passed in language it asked for, its
+// Accept-Language header and its channel's default
+func (c *Client) negotiateLanguage(requested string) {
+	c.language.Store(c.hub.negotiateLanguage(c.channel, requested, c.acceptLanguage))
+}
+
+// translate returns the passed in text in the language of this client
+func (c *Client) translate(text string) string {
+	return c.hub.translate(c.Language(), text)
+}
+
+// setChannel applies the passed in channel definition to the client
+func (c *Client) setChannel(channel *Channel) {
+	c.channel = channel
+	if channel != nil && channel.RateLimit > 0 {
+		c.limiter = newEventLimiter(channel.RateLimit, time.Minute)
+	}
+}
+
+// featureEnabled returns whether the passed in feature is enabled for the client's channel
+func (c *Client) featureEnabled(feature string) bool {
+	return c.channel == nil || c.channel.FeatureEnabled(feature)
+}
+
+// resumeSession takes over the identity of the passed in session, restoring its outbound format if restoreFormat
+// is set because none was asked for at this handshake
+func (c *Client) resumeSession(sess *session, restoreFormat bool) {
+	c.Id = sess.clientID
+	c.UserUrn = sess.userURN
+	if sess.userToken != "" {
+		c.UserToken = sess.userToken
+	}
+	if restoreFormat && sess.outboundFormat != "" {
+		c.setOutboundFormat(sess.outboundFormat)
+	}
+	c.sessionToken = sess.token
+	c.contactURN = sess.contactURN
+	if tag, err := language.Parse(sess.language); err == nil && sess.language != "" {
+		c.language.Store(tag)
+	}
+
+	c.session.SetAttributes(attribute.String("webchat.client_id", c.Id), attribute.Bool("webchat.session_resumed", true))
+	c.addLogField("client_id", c.Id)
+	if c.UserUrn != "" {
+		c.addLogField("urn", c.UserUrn)
+	}
+}
+
+// sendMessage queues the passed in message to be written to the client by its write pump
+func (c *Client) sendMessage(ctx context.Context, msg interface{}) {
+	c.send <- &outboundMessage{ctx: ctx, msg: msg}
+}
+
+// Log returns the logger of this client, it includes the identity of the client and its conversation
+func (c *Client) Log() *logrus.Entry {
+	c.logMutex.RLock()
+	defer c.logMutex.RUnlock()
+	return c.log
+}
+
+// addLogField adds a field to every message logged by this client from now on
+func (c *Client) addLogField(key string, value interface{}) {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+	c.log = c.log.WithField(key, value)
+}
+
+// extendReadDeadline pushes back the time at which we consider the client dead, called whenever
+// we hear anything from it
+func (c *Client) extendReadDeadline() error {
+	return c.Connection.SetReadDeadline(time.Now().Add(c.hub.pingTimeout()))
+}
+
+// closeWithCode sends a close frame with the passed in code and reason, it is safe to call concurrently with writePump
+func (c *Client) closeWithCode(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = c.Connection.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
 }
 
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
 		_ = c.Connection.Close()
+		c.session.End()
 	}()
+	defer c.recoverPanic("read pump")
+
+	c.Connection.SetReadLimit(c.hub.Config().WSMaxMessageSize)
+	_ = c.extendReadDeadline()
+	c.Connection.SetPongHandler(func(string) error { return c.extendReadDeadline() })
 
 	for {
-		_, rawData, err := c.Connection.ReadMessage()
+		msgType, rawData, err := c.Connection.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				logrus.Errorln("Failed to read message:", err)
+			if err == websocket.ErrReadLimit {
+				// the websocket library has already sent the client a message too big close frame
+				c.hub.stats.incOversized()
+				c.Log().Warnln("Client sent message over size limit, closing connection")
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				c.Log().Infoln("Client pong timed out, closing connection")
+				c.closeWithCode(closePongTimeout, "Client pong timed out")
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				c.Log().Errorln("Failed to read message:", err)
 			}
 			break
 		}
 
+		// any message, including a pong, proves the client is still alive
+		_ = c.extendReadDeadline()
+
+		if msgType == websocket.BinaryMessage && !c.hub.Config().WSAllowBinary {
+			c.hub.stats.incBinary()
+			c.Log().Warnln("Client sent binary message, closing connection")
+			c.closeWithCode(websocket.CloseUnsupportedData, "Binary messages are not supported")
+			break
+		}
+
 		// skip message if it pong message
 		if string(rawData) == "#2" {
 			continue
 		}
 
+		if c.UserUrn != "" && !c.agent {
+			c.hub.notifyPresence(c.hub.presence.seen(c.UserUrn, time.Now()))
+		}
+
 		// handle new WebSocket message
 		msg := &WSMessage{}
 		jsonError := json.Unmarshal(rawData, msg)
-		if jsonError == nil {
-			err, errMsg := HandleWSMessage(c, msg)
-			if err != nil {
-				logrus.Errorln(errMsg, err)
+		if jsonError != nil {
+			if !c.handleInvalidMessage(jsonError) {
+				break
 			}
+			continue
+		}
+
+		if c.limiter != nil && !c.limiter.allow(time.Now()) {
+			c.hub.stats.incRateLimited()
+			c.Log().WithField("event", msg.Event).Warnln("Client exceeded its channel's rate limit, dropping event")
+			c.replyError(msg, "RateLimitError", "Too many events, slow down")
+			continue
+		}
+
+		c.handleMessage(msg)
+	}
+}
+
+// handleMessage handles a single event sent by the client within its own span
+func (c *Client) handleMessage(msg *WSMessage) {
+	ctx, span := tracer.Start(c.ctx, "webchat.event "+msg.Event, trace.WithAttributes(
+		attribute.String("webchat.event", msg.Event),
+		attribute.Int("webchat.cid", msg.CID),
+	))
+	defer span.End()
+
+	// a bug handling one event shouldn't cost the client its connection
+	defer func() {
+		if r := recover(); r != nil {
+			c.logPanic(r, "event "+msg.Event)
+			span.SetStatus(codes.Error, "panic handling event")
+			c.replyError(msg, "EventError", "Failed to handle event")
 		}
+	}()
+
+	var err error
+	var errMsg string
+	if c.agent {
+		err, errMsg = HandleAgentMessage(ctx, c, msg)
+	} else {
+		err, errMsg = HandleWSMessage(ctx, c, msg)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, errMsg)
+		c.Log().WithField("event", msg.Event).Errorln(errMsg, err)
+
+		name := "EventError"
+		var courierErr *courierError
+		if errors.As(err, &courierErr) {
+			name = "CourierError"
+		}
+		c.replyError(msg, name, strings.TrimSuffix(errMsg, ":"))
+	}
+}
+
+// replyError lets the client know the passed in event failed, if it is waiting for a response to it
+func (c *Client) replyError(msg *WSMessage, name string, message string) {
+	if msg.CID == 0 {
+		return
+	}
+	c.sendMessage(c.ctx, map[string]interface{}{
+		"rid": msg.CID,
+		"error": map[string]interface{}{
+			"name":    name,
+			"message": c.translate(message),
+		},
+	})
+}
+
+// recoverPanic recovers from a panic in one of the client's goroutines, logging it. It must be deferred.
+func (c *Client) recoverPanic(where string) {
+	if r := recover(); r != nil {
+		c.logPanic(r, where)
+	}
+}
+
+// logPanic logs a recovered panic with its stack, which reports it to Sentry when that is configured
+func (c *Client) logPanic(r interface{}, where string) {
+	c.hub.stats.incPanics()
+	c.Log().WithField("stack", string(debug.Stack())).Errorf("Recovered from panic in %s: %v", where, r)
+}
+
+// handleInvalidMessage records a message we couldn't parse, letting the client know about it. It returns
+// false if the client has sent too many invalid messages and has been disconnected
+func (c *Client) handleInvalidMessage(err error) bool {
+	c.hub.stats.incInvalid()
+	c.invalidMessages++
+
+	if c.invalidMessages >= c.hub.Config().WSMaxInvalidMessages {
+		c.hub.stats.incInvalidDisconnects()
+		c.Log().Warnln("Client sent too many invalid messages, closing connection:", err)
+		c.closeWithCode(websocket.CloseInvalidFramePayloadData, "Too many invalid messages")
+		return false
 	}
+
+	c.Log().Warnln("Client sent invalid message:", err)
+	c.sendMessage(c.ctx, map[string]interface{}{
+		"event": "#error",
+		"data": map[string]interface{}{
+			"name":    "InvalidMessageError",
+			"message": c.translate("Message could not be parsed as JSON"),
+		},
+	})
+	return true
 }
 
 func (c *Client) writePump() {
-	ticket := time.NewTicker(pingPeriod)
+	ticket := time.NewTicker(c.hub.pingInterval())
 	defer func() {
 		ticket.Stop()
 		_ = c.Connection.Close()
+
+		// closing the connection ends the read pump, which unregisters us, until then the hub and read pump
+		// may still be sending us messages which mustn't block them
+		for range c.send {
+		}
 	}()
+	defer c.recoverPanic("write pump")
 	for {
 		select {
-		case msg, ok := <-c.send:
+		case out, ok := <-c.send:
+			_ = c.Connection.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
+				_ = c.Connection.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			if msg != nil {
-				err := c.Connection.WriteJSON(msg)
+			if out.msg != nil {
+				err := c.deliver(out)
 				if err != nil {
-					logrus.Errorln("Failed to send json message:", err)
+					c.Log().Errorln("Failed to send json message:", err)
 					return
 				}
 			}
 		case <-ticket.C:
 			// ping message sending
+			_ = c.Connection.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Connection.EnableWriteCompression(false)
 			err := c.Connection.WriteMessage(websocket.TextMessage, []byte("#1"))
 			if err != nil {
-				logrus.Errorln("Failed to send ping message:", err)
+				c.Log().Errorln("Failed to send ping message:", err)
 				return
 			}
 		}
 	}
 }
+
+// deliver writes the passed in message to the client within a span that is a child of the context it was sent
+// from. A message we panic writing is dropped rather than closing the connection.
+func (c *Client) deliver(out *outboundMessage) error {
+	_, span := tracer.Start(out.ctx, "webchat.deliver", trace.WithAttributes(
+		attribute.String("webchat.request_id", c.RequestID),
+	))
+	defer span.End()
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.logPanic(r, "deliver")
+			span.SetStatus(codes.Error, "panic delivering message")
+		}
+	}()
+
+	for _, event := range outboundEvents(out.msg, c.OutboundFormat()) {
+		err := c.writeJSON(event)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to write message")
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSON encodes and writes the passed in message, only compressing it if it is over our threshold
+func (c *Client) writeJSON(msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.Connection.EnableWriteCompression(len(data) >= c.hub.Config().WSCompressionThreshold)
+	return c.Connection.WriteMessage(websocket.TextMessage, data)
+}
@@ -0,0 +1,135 @@
+package webchat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/greatnonprofits-nfp/websocket-go/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ConversationClosedEvent tells a widget the conversation has been closed, such as by a flow ending
+type ConversationClosedEvent struct {
+	Reason string `json:"reason,omitempty" validate:"max=640"`
+}
+
+// ContactUpdatedEvent tells a widget the contact's details have changed
+type ContactUpdatedEvent struct {
+	Name     string            `json:"name"               validate:"required_without=Fields,max=128"`
+	Language string            `json:"language,omitempty" validate:"omitempty,max=3"`
+	Fields   map[string]string `json:"fields,omitempty"   validate:"omitempty,min=1"`
+}
+
+// OpenURLEvent asks a widget to open a URL for the contact
+type OpenURLEvent struct {
+	URL       string `json:"url"        validate:"required,http_url"`
+	NewWindow bool   `json:"new_window"`
+}
+
+// eventSchemas are the events courier can push to widgets, each with the struct its data must decode into and
+// validate as
+var eventSchemas = map[string]func() interface{}{
+	"conversation_closed": func() interface{} { return &ConversationClosedEvent{} },
+	"contact_updated":     func() interface{} { return &ContactUpdatedEvent{} },
+	"open_url":            func() interface{} { return &OpenURLEvent{} },
+}
+
+// eventNames returns the names of the events in our schemas in order
+func eventNames() []string {
+	names := make([]string, 0, len(eventSchemas))
+	for name := range eventSchemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// eventPayload is an event posted by courier for a contact
+type eventPayload struct {
+	ID      string          `json:"id"`
+	To      string          `json:"to"      validate:"required"`
+	Channel string          `json:"channel"`
+	Event   string          `json:"event"   validate:"required"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// decodeData decodes and validates the data of this event against the schema of its event, returning the
+// event widgets are sent
+func (p *eventPayload) decodeData() (map[string]interface{}, error) {
+	schema, found := eventSchemas[p.Event]
+	if !found {
+		return nil, fmt.Errorf("unknown event %s, must be one of %s", p.Event, strings.Join(eventNames(), ", "))
+	}
+
+	data := schema()
+	raw := p.Data
+	if len(raw) == 0 || string(raw) == "null" {
+		raw = json.RawMessage("{}")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(data); err != nil {
+		return nil, fmt.Errorf("invalid %s data: %s", p.Event, err)
+	}
+	if err := utils.Validate(data); err != nil {
+		return nil, fmt.Errorf("invalid %s data: %s", p.Event, strings.Join(utils.ErrorDetails(err), ", "))
+	}
+
+	return map[string]interface{}{
+		"event": p.Event,
+		"data":  data,
+	}, nil
+}
+
+// EventReceived handles an event posted by courier, validating its data against the schema of its event and
+// routing it to the client subscribed to its URN like a message. It responds with a 202 if the client is
+// connected or the event was kept for it to resume its session, a 404 if it isn't connected, a 400 if the event
+// is invalid, a 403 if the request can't reach the contact's channel and a 503 if the hub is overloaded.
+func EventReceived(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "webchat.event_received", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	payload := &eventPayload{}
+	err := utils.DecodeAndValidateJSONWithLimit(payload, r, hub.Config().MaxBodySize)
+	if err != nil {
+		span.RecordError(err)
+		writeBodyError(w, "invalid event", err)
+		return
+	}
+	span.SetAttributes(attribute.String("webchat.event", payload.Event), attribute.String("webchat.urn", payload.To))
+
+	event, err := payload.decodeData()
+	if err != nil {
+		span.RecordError(err)
+		_ = utils.WriteJSONError(w, http.StatusBadRequest, "invalid event", err)
+		return
+	}
+	if err := hub.checkCourierTarget(r.Context(), payload.To); err != nil {
+		span.RecordError(err)
+		_ = utils.WriteJSONError(w, http.StatusForbidden, "forbidden", err)
+		return
+	}
+
+	status, err := hub.Deliver(ctx, payload.To, event)
+	if err != nil {
+		span.RecordError(err)
+		hub.logger.WithField("request_id", middleware.GetReqID(r.Context())).WithField("event", payload.Event).Errorln("Failed to route event:", err)
+		_ = utils.WriteJSONError(w, http.StatusServiceUnavailable, "server is overloaded, try again later", nil)
+		return
+	}
+
+	code := http.StatusAccepted
+	if status == RouteNotConnected {
+		code = http.StatusNotFound
+	}
+	_ = utils.WriteJSONResponse(w, code, &msgReceivedResponse{ID: payload.ID, Status: routeStatuses[status]})
+}
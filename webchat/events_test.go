@@ -0,0 +1,44 @@
+package webchat
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEventSchemas(t *testing.T) {
+	tcs := []struct {
+		event string
+		data  string
+		valid bool
+	}{
+		{"conversation_closed", ``, true},
+		{"conversation_closed", `{"reason":"flow ended"}`, true},
+		{"conversation_closed", `{"reason":"flow ended","by":"bot"}`, false},
+		{"contact_updated", `{"name":"Bob"}`, true},
+		{"contact_updated", `{"fields":{"age":"32"}}`, true},
+		{"contact_updated", `{"name":"Bob","language":"eng","fields":{"age":"32"}}`, true},
+		{"contact_updated", `{}`, false},
+		{"contact_updated", `{"fields":{}}`, false},
+		{"contact_updated", `{"name":"Bob","fields":{}}`, false},
+		{"contact_updated", `{"name":"Bob","language":"english"}`, false},
+		{"contact_updated", `{"fields":{"age":32}}`, false},
+		{"open_url", `{"url":"https://example.com/help"}`, true},
+		{"open_url", `{"url":"http://example.com","new_window":true}`, true},
+		{"open_url", `{}`, false},
+		{"open_url", `{"url":"javascript:alert(1)"}`, false},
+		{"open_url", `{"url":"data:text/html,hi"}`, false},
+		{"open_url", `{"url":"ftp://example.com/file"}`, false},
+		{"open_url", `{"url":"/relative"}`, false},
+		{"bogus", `{}`, false},
+	}
+
+	for _, tc := range tcs {
+		payload := &eventPayload{To: "webchat:1234", Event: tc.event, Data: json.RawMessage(tc.data)}
+		event, err := payload.decodeData()
+		if tc.valid && (err != nil || event["event"] != tc.event) {
+			t.Errorf("%s %s: expected valid event, got %v %v", tc.event, tc.data, event, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("%s %s: expected error, got %v", tc.event, tc.data, event)
+		}
+	}
+}
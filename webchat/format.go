@@ -0,0 +1,44 @@
+package webchat
+
+const (
+	// OutboundFormatPublish sends messages from courier as SocketCluster #publish events on the contact's channel
+	OutboundFormatPublish = "publish"
+
+	// OutboundFormatEvent sends messages from courier as custom receivedMessageFromChannel events
+	OutboundFormatEvent = "event"
+
+	// OutboundFormatBoth sends messages from courier as both events, which older widgets expect
+	OutboundFormatBoth = "both"
+)
+
+// isOutboundFormat returns whether the passed in string is one of our outbound formats
+func isOutboundFormat(format string) bool {
+	return format == OutboundFormatPublish || format == OutboundFormatEvent || format == OutboundFormatBoth
+}
+
+// outboundEvents returns the events the passed in message is written to a client as. Messages from courier are
+// written according to the passed in format, anything else is written as is.
+func outboundEvents(msg interface{}, format string) []interface{} {
+	payload, isPayload := msg.(*newMsgPayload)
+	if !isPayload {
+		return []interface{}{msg}
+	}
+
+	events := make([]interface{}, 0, 2)
+	if format == OutboundFormatPublish || format == OutboundFormatBoth {
+		events = append(events, map[string]interface{}{
+			"event": "#publish",
+			"data": map[string]interface{}{
+				"channel": payload.To,
+				"data":    payload,
+			},
+		})
+	}
+	if format == OutboundFormatEvent || format == OutboundFormatBoth {
+		events = append(events, map[string]interface{}{
+			"event": "receivedMessageFromChannel",
+			"data":  payload,
+		})
+	}
+	return events
+}
@@ -0,0 +1,107 @@
+package webchat
+
+import (
+	"context"
+	"testing"
+
+	server "github.com/greatnonprofits-nfp/websocket-go"
+)
+
+func TestOutboundEvents(t *testing.T) {
+	payload := &newMsgPayload{ID: "1", Text: "hi", To: "webchat:1234"}
+
+	tcs := []struct {
+		format string
+		events []string
+	}{
+		{OutboundFormatBoth, []string{"#publish", "receivedMessageFromChannel"}},
+		{OutboundFormatPublish, []string{"#publish"}},
+		{OutboundFormatEvent, []string{"receivedMessageFromChannel"}},
+		{"", []string{}},
+	}
+
+	for _, tc := range tcs {
+		events := outboundEvents(payload, tc.format)
+		if len(events) != len(tc.events) {
+			t.Errorf("format %q: expected %d events, got %d", tc.format, len(tc.events), len(events))
+			continue
+		}
+		for i, event := range events {
+			name := event.(map[string]interface{})["event"]
+			if name != tc.events[i] {
+				t.Errorf("format %q: expected event %d to be %s, got %s", tc.format, i, tc.events[i], name)
+			}
+		}
+	}
+
+	// #publish events are on the contact's channel and carry the message as is
+	publish := outboundEvents(payload, OutboundFormatPublish)[0].(map[string]interface{})["data"].(map[string]interface{})
+	if publish["channel"] != "webchat:1234" || publish["data"] != payload {
+		t.Errorf("unexpected #publish data: %v", publish)
+	}
+
+	// anything which isn't a message from courier is written as is whatever the format
+	status := messageStatusEvent("1", msgStatusSent)
+	for _, format := range []string{OutboundFormatBoth, OutboundFormatPublish, OutboundFormatEvent} {
+		events := outboundEvents(status, format)
+		if len(events) != 1 || events[0].(map[string]interface{})["event"] != "messageStatus" {
+			t.Errorf("format %q: expected message status to be written as is, got %v", format, events)
+		}
+	}
+}
+
+func TestHandshakeOutboundFormat(t *testing.T) {
+	tcs := []struct {
+		label         string
+		defaultFormat string
+		handshake     string
+		format        string
+		events        []string
+	}{
+		{"legacy widget", "both", `{}`, "both", []string{"#publish", "receivedMessageFromChannel"}},
+		{"legacy widget without data", "both", `null`, "both", []string{"#publish", "receivedMessageFromChannel"}},
+		{"publish", "both", `{"outboundFormat":"publish"}`, "publish", []string{"#publish"}},
+		{"event", "both", `{"outboundFormat":"event"}`, "event", []string{"receivedMessageFromChannel"}},
+		{"both", "publish", `{"outboundFormat":"both"}`, "both", []string{"#publish", "receivedMessageFromChannel"}},
+		{"invalid gets default", "both", `{"outboundFormat":"bogus"}`, "both", []string{"#publish", "receivedMessageFromChannel"}},
+		{"invalid gets configured default", "event", `{"outboundFormat":"bogus"}`, "event", []string{"receivedMessageFromChannel"}},
+		{"legacy widget gets configured default", "publish", `{}`, "publish", []string{"#publish"}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.label, func(t *testing.T) {
+			hub := newTestHub(t, func(config *server.Config) { config.WSOutboundFormat = tc.defaultFormat })
+			widget := connectWidget(t, hub, "8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "")
+
+			response := widget.handshake(tc.handshake)
+			if response["outboundFormat"] != tc.format {
+				t.Errorf("expected handshake outbound format %s, got %v", tc.format, response["outboundFormat"])
+			}
+
+			widget.subscribe(hub, "webchat:1234")
+			for _, id := range []string{"1", "2"} {
+				status, err := hub.Deliver(context.Background(), "webchat:1234", &newMsgPayload{ID: id, Text: "hi", To: "webchat:1234"})
+				if err != nil || status != RouteDelivered {
+					t.Fatalf("expected message to be delivered, got %d %v", status, err)
+				}
+			}
+
+			// each message is written as exactly the expected events, in order
+			for _, id := range []string{"1", "2"} {
+				for _, name := range tc.events {
+					event := widget.read()
+					if event["event"] != name {
+						t.Fatalf("expected %s event for message %s, got %v", name, id, event)
+					}
+					data := event["data"].(map[string]interface{})
+					if name == "#publish" {
+						data = data["data"].(map[string]interface{})
+					}
+					if data["id"] != id {
+						t.Fatalf("expected %s event for message %s, got %v", name, id, event)
+					}
+				}
+			}
+		})
+	}
+}
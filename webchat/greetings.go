@@ -0,0 +1,72 @@
+package webchat
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var greetedBucket = []byte("greeted")
+
+// GreetingStore records which contacts we have started a conversation with, so that only new contacts are
+// greeted however often they register and whichever registration cache saw them
+type GreetingStore interface {
+	// MarkGreeted records the contact with the passed in UUID as greeted, returning whether it wasn't already
+	MarkGreeted(contactUUID string) (bool, error)
+
+	Close() error
+}
+
+// boltGreetingStore is a GreetingStore backed by a BoltDB file, keeping when each contact was greeted
+type boltGreetingStore struct {
+	db *bolt.DB
+}
+
+// NewBoltGreetingStore opens or creates the BoltDB greeting store at the passed in path
+func NewBoltGreetingStore(path string) (GreetingStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening greeting store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(greetedBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating greeting store bucket: %w", err)
+	}
+	return &boltGreetingStore{db: db}, nil
+}
+
+func (s *boltGreetingStore) MarkGreeted(contactUUID string) (bool, error) {
+	marked := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(greetedBucket)
+		if bucket.Get([]byte(contactUUID)) != nil {
+			return nil
+		}
+		marked = true
+		return bucket.Put([]byte(contactUUID), []byte(time.Now().Format(time.RFC3339)))
+	})
+	return marked && err == nil, err
+}
+
+func (s *boltGreetingStore) Close() error {
+	return s.db.Close()
+}
+
+// isNewContact returns whether the passed in contact has never been greeted, recording that it now has been.
+// Without a greeting store no contact is known to be new.
+func (h *Hub) isNewContact(contact RegisterResponseData) bool {
+	if h.greetings == nil {
+		return false
+	}
+	marked, err := h.greetings.MarkGreeted(contact.ContactUUID)
+	if err != nil {
+		h.logger.WithField("comp", "greetings").WithError(err).Error("error marking contact as greeted")
+		return false
+	}
+	return marked
+}
@@ -0,0 +1,95 @@
+package webchat
+
+import (
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	server "github.com/greatnonprofits-nfp/websocket-go"
+)
+
+// countingGreetingStore is a greeting store which remembers contacts in memory and counts how often it is asked
+type countingGreetingStore struct {
+	mutex   sync.Mutex
+	greeted map[string]bool
+	calls   int
+}
+
+func (s *countingGreetingStore) MarkGreeted(contactUUID string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls++
+	if s.greeted[contactUUID] {
+		return false, nil
+	}
+	s.greeted[contactUUID] = true
+	return true, nil
+}
+func (s *countingGreetingStore) Close() error { return nil }
+
+// count returns how often the store has been asked to mark a contact
+func (s *countingGreetingStore) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls
+}
+
+func TestBoltGreetingStore(t *testing.T) {
+	store, err := NewBoltGreetingStore(filepath.Join(t.TempDir(), "greetings.db"))
+	if err != nil {
+		t.Fatalf("error opening greeting store: %s", err)
+	}
+	defer store.Close()
+
+	for i, expected := range []bool{true, false, false} {
+		marked, err := store.MarkGreeted("c1")
+		if err != nil || marked != expected {
+			t.Errorf("mark %d: expected %v, got %v %v", i, expected, marked, err)
+		}
+	}
+	if marked, _ := store.MarkGreeted("c2"); !marked {
+		t.Errorf("expected another contact to be new")
+	}
+}
+
+func TestRegisterGreeting(t *testing.T) {
+	courier := newTestCourier(t, map[string]http.HandlerFunc{
+		"/c/wch/" + testChannelA + "/register": courierResponse(200, `{"message":"ok","data":[{"contact_uuid":"c1","contact_token":"t1","contact_urn":"webchat:1234"}]}`),
+		"/c/wch/" + testChannelB + "/register": courierResponse(200, `{"message":"ok","data":[{"contact_uuid":"c2","contact_token":"t2","contact_urn":"webchat:5678"}]}`),
+	})
+	hub := newTestChannelsHub(t, `[
+		{"uuid": "`+testChannelA+`", "courier_url": "`+courier.URL+`", "welcome_message": "Hello!"},
+		{"uuid": "`+testChannelB+`", "courier_url": "`+courier.URL+`"}
+	]`, func(config *server.Config) { config.RegistrationCacheTTL = 0 })
+	store := &countingGreetingStore{greeted: make(map[string]bool)}
+	hub.SetGreetingStore(store)
+
+	// registrations aren't cached so each goes to courier, but the contact is only greeted the first time
+	widget := connectWidget(t, hub, testChannelA, "")
+	widget.handshake(`{}`)
+	for i := 0; i < 3; i++ {
+		widget.send(3, "registerUser", `{}`)
+		okResponse(t, widget.read(), 3, &map[string]string{})
+		if i == 0 {
+			if event := widget.read(); event["event"] != "#publish" {
+				t.Fatalf("expected welcome message after first registration, got %v", event)
+			}
+			widget.read()
+		}
+	}
+	assertStillConnected(t, widget)
+	if store.count() != 3 {
+		t.Errorf("expected greeting store to be asked for each registration, got %d", store.count())
+	}
+
+	// channels with nothing to greet contacts with don't touch the store
+	other := connectWidget(t, hub, testChannelB, "")
+	other.handshake(`{}`)
+	other.send(3, "registerUser", `{}`)
+	okResponse(t, other.read(), 3, &map[string]string{})
+	assertStillConnected(t, other)
+	if store.count() != 3 {
+		t.Errorf("expected greeting store not to be asked for channel without greeting, got %d", store.count())
+	}
+}
@@ -1,14 +1,23 @@
 package webchat
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/chilts/sid"
+	"github.com/go-chi/chi/middleware"
 	"github.com/greatnonprofits-nfp/websocket-go/utils"
 	"github.com/pbnjay/memory"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"html/template"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -17,46 +26,186 @@ func Index(w http.ResponseWriter, r *http.Request) {
 }
 
 type newMsgPayload struct {
-	ID          string      `json:"id"`
+	ID          string      `json:"id" validate:"required"`
 	Text        string      `json:"text"`
-	To          string      `json:"to"`
+	To          string      `json:"to" validate:"required"`
 	ToNoPlus    string      `json:"to_no_plus"`
 	From        string      `json:"from"`
 	FromNoPlus  string      `json:"from_no_plus"`
 	Channel     string      `json:"channel"`
 	Metadata    interface{} `json:"metadata"`
 	Attachments interface{} `json:"attachments"`
+
+	// the name of the agent who sent this message, if it didn't come from courier
+	agent string
+}
+
+// msgReceivedResponse is our response to courier for a message it posted
+type msgReceivedResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
 }
 
+// historyMessage returns this message as it is recorded in the history of its contact
+func (p *newMsgPayload) historyMessage() GetHistoryResponseData {
+	return GetHistoryResponseData{Message: p.Text, Origin: historyOriginChannel, Metadata: p.Metadata, Attachments: p.Attachments}
+}
+
+const (
+	msgStatusQueued       = "queued"
+	msgStatusBuffered     = "buffered"
+	msgStatusNotConnected = "not_connected"
+	msgStatusInvalid      = "invalid"
+	msgStatusOverloaded   = "overloaded"
+	msgStatusUnconfirmed  = "queued_unconfirmed"
+	msgStatusForbidden    = "forbidden"
+)
+
+// MessageReceived handles a message posted by courier, routing it to the client subscribed to its URN. It
+// responds with a 202 if the client is connected and the message queued, or the hub took the message but didn't
+// route it in time to say, a 404 if it isn't connected, a 400 if the message is invalid, a 403 if the request
+// can't reach the contact's channel and a 503 if the hub's queue is full.
 func MessageReceived(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		fmt.Fprintf(w, "ParseForm() err: %v", err)
+		_ = utils.WriteJSONError(w, http.StatusBadRequest, "unable to parse request", err)
 		return
 	}
 
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "webchat.message_received", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
 	payload := &newMsgPayload{}
-	err := utils.DecodeAndValidateJSON(payload, r)
+	err := utils.DecodeAndValidateJSONWithLimit(payload, r, hub.Config().MaxBodySize)
+	if err != nil {
+		span.RecordError(err)
+		writeBodyError(w, "invalid message", err)
+		return
+	}
+	span.SetAttributes(attribute.String("webchat.msg_id", payload.ID), attribute.String("webchat.urn", payload.To))
+
+	if err := hub.checkCourierTarget(r.Context(), payload.To); err != nil {
+		span.RecordError(err)
+		_ = utils.WriteJSONError(w, http.StatusForbidden, "forbidden", err)
+		return
+	}
+
+	status, err := hub.Deliver(ctx, payload.To, payload)
 	if err != nil {
+		span.RecordError(err)
+		hub.logger.WithField("request_id", middleware.GetReqID(r.Context())).WithField("msg_id", payload.ID).Errorln("Failed to route message:", err)
+		_ = utils.WriteJSONError(w, http.StatusServiceUnavailable, "server is overloaded, try again later", nil)
 		return
 	}
 
-	hub.receive <- &HubMessage{
-		client: payload.To,
-		msg: map[string]interface{}{
-			"event": "#publish",
-			"data": map[string]interface{}{
-				"channel": payload.To,
-				"data":    payload,
-			},
-		},
+	// courier has the message whether or not the contact is here to see it, so it's part of their history either way
+	hub.recordHistory(payload.To, payload.historyMessage())
+
+	code := http.StatusAccepted
+	if status == RouteNotConnected {
+		code = http.StatusNotFound
 	}
-	hub.receive <- &HubMessage{
-		client: payload.To,
-		msg: map[string]interface{}{
-			"event": "receivedMessageFromChannel",
-			"data":  payload,
-		},
+	_ = utils.WriteJSONResponse(w, code, &msgReceivedResponse{ID: payload.ID, Status: routeStatuses[status]})
+}
+
+// routeStatuses are the statuses we report to courier for each route status
+var routeStatuses = map[RouteStatus]string{
+	RouteDelivered:    msgStatusQueued,
+	RouteBuffered:     msgStatusBuffered,
+	RouteNotConnected: msgStatusNotConnected,
+	RouteUnconfirmed:  msgStatusUnconfirmed,
+}
+
+// writeBodyError writes the error response for a request body we couldn't decode
+func writeBodyError(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, utils.ErrBodyTooLarge) {
+		_ = utils.WriteJSONError(w, http.StatusRequestEntityTooLarge, "request body too large", nil)
+		return
 	}
+	_ = utils.WriteJSONError(w, http.StatusBadRequest, message, err)
+}
+
+// batchMsgResult is the result of routing a single message of a batch
+type batchMsgResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchReceivedResponse is our response to courier for a batch of messages
+type batchReceivedResponse struct {
+	Results []*batchMsgResult `json:"results"`
+}
+
+// BatchMessagesReceived handles a JSON array of messages posted by courier, routing each to the client
+// subscribed to its URN. It responds with a 200 and the result of each message in the order they were posted,
+// or a 400 or 413 if the batch as a whole can't be accepted.
+func BatchMessagesReceived(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "webchat.batch_received", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	config := hub.Config()
+	body, err := utils.ReadBody(r, config.BatchMaxBodySize)
+	if err != nil {
+		span.RecordError(err)
+		writeBodyError(w, "unable to read request body", err)
+		return
+	}
+
+	payloads := make([]*newMsgPayload, 0)
+	if err := json.Unmarshal(body, &payloads); err != nil {
+		span.RecordError(err)
+		_ = utils.WriteJSONError(w, http.StatusBadRequest, "unable to parse request JSON", err)
+		return
+	}
+	if len(payloads) > config.BatchMaxMessages {
+		_ = utils.WriteJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("batch can't contain more than %d messages", config.BatchMaxMessages), nil)
+		return
+	}
+	span.SetAttributes(attribute.Int("webchat.batch_size", len(payloads)))
+
+	// queue every valid message first, waiting for room in the hub's queue as a batch can be as big as it, then
+	// wait for them all to be routed
+	deadline, cancel := context.WithTimeout(context.Background(), hubReplyTimeout)
+	defer cancel()
+	results := make([]*batchMsgResult, len(payloads))
+	queued := make([]*HubMessage, len(payloads))
+	for i, payload := range payloads {
+		if payload == nil {
+			results[i] = &batchMsgResult{Status: msgStatusInvalid, Error: "message can't be null"}
+			continue
+		}
+
+		results[i] = &batchMsgResult{ID: payload.ID}
+		if err := utils.Validate(payload); err != nil {
+			results[i].Status = msgStatusInvalid
+			results[i].Error = strings.Join(utils.ErrorDetails(err), ", ")
+			continue
+		}
+		if err := hub.checkCourierTarget(r.Context(), payload.To); err != nil {
+			results[i].Status = msgStatusForbidden
+			results[i].Error = err.Error()
+			continue
+		}
+
+		queued[i], err = hub.enqueueBefore(ctx, deadline.Done(), payload.To, payload)
+		if err != nil {
+			results[i].Status = msgStatusOverloaded
+		}
+	}
+
+	for i, hubMsg := range queued {
+		if hubMsg == nil {
+			continue
+		}
+
+		status := hubMsg.wait(deadline.Done())
+		results[i].Status = routeStatuses[status]
+		hub.recordHistory(payloads[i].To, payloads[i].historyMessage())
+	}
+
+	_ = utils.WriteJSONResponse(w, http.StatusOK, &batchReceivedResponse{Results: results})
 }
 
 type pingPayload struct {
@@ -64,12 +213,14 @@ type pingPayload struct {
 	HostName string
 	UpTime   int64
 	FreeMem  int64
+	Stats    StatsSnapshot
 }
 
-func Ping(startTime time.Time, w http.ResponseWriter, r *http.Request) {
+func Ping(hub *Hub, startTime time.Time, w http.ResponseWriter, r *http.Request) {
+	log := hub.logger.WithField("request_id", middleware.GetReqID(r.Context()))
 	hostname, err := os.Hostname()
 	if err != nil {
-		logrus.Println(err)
+		log.Println(err)
 		hostname = ""
 		return
 	}
@@ -79,28 +230,63 @@ func Ping(startTime time.Time, w http.ResponseWriter, r *http.Request) {
 		HostName: hostname,
 		UpTime:   int64(time.Since(startTime).Seconds()),
 		FreeMem:  int64(memory.FreeMemory()),
+		Stats:    hub.Stats().Snapshot(),
 	}
 	tmpl, _ := template.ParseFiles("templates/ping.html")
 	err = tmpl.Execute(w, data)
 	if err != nil {
-		logrus.Errorln(err)
+		log.Errorln(err)
 	}
 }
 
 func ServeWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	requestID := middleware.GetReqID(r.Context())
+	hostApi := r.URL.Query().Get("hostApi")
+	channelUUID := r.URL.Query().Get("channelUUID")
+	log := hub.logger.WithFields(logrus.Fields{"comp": "client", "request_id": requestID, "channel_uuid": channelUUID})
+
+	// channels defined on our side decide the courier host, otherwise the widget does
+	var channel *Channel
+	if hub.channels.Enabled() {
+		channel = hub.channels.Get(channelUUID)
+		if channel == nil {
+			log.Warnln("Rejected websocket connection for unknown channel")
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		hostApi = channel.CourierURL
+	} else if !hub.checkCourierHost(hostApi) {
+		log.WithField("host_api", hostApi).Warnln("Rejected websocket connection for unknown courier host")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// visitors with a valid cookie keep their id across connections, new ones get a cookie for theirs
+	var header http.Header
+	id := hub.visitorID(r)
+	if id == "" {
+		id = sid.IdBase64()
+		if cookie := hub.visitorCookie(r, id); cookie != nil {
+			header = http.Header{"Set-Cookie": {cookie.String()}}
+		}
+	}
+
+	conn, err := hub.upgrader.Upgrade(w, r, header)
 	if err != nil {
-		logrus.Errorln(err)
+		log.Errorln(err)
+		return
 	}
 
-	client := &Client{
-		Id:          sid.IdBase64(),
-		ChannelUUID: r.URL.Query().Get("channelUUID"),
-		HostApi:     r.URL.Query().Get("hostApi"),
-		UserToken:   r.URL.Query().Get("userToken"),
-		Connection:  conn,
-		hub:         hub,
-		send:        make(chan interface{}),
+	client := newClient(hub, conn, id, channelUUID, hostApi, r.URL.Query().Get("userToken"), requestID)
+	client.setChannel(channel)
+	client.acceptLanguage = r.Header.Get("Accept-Language")
+	client.negotiateLanguage("")
+	client.startSession(r)
+	if hub.Config().WSEnableCompression {
+		err = conn.SetCompressionLevel(hub.Config().WSCompressionLevel)
+		if err != nil {
+			client.Log().Errorln("Failed to set compression level:", err)
+		}
 	}
 
 	go client.writePump()
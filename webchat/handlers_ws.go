@@ -2,27 +2,142 @@ package webchat
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/go-chi/chi/middleware"
 	"github.com/greatnonprofits-nfp/websocket-go/utils"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// newCourierRequest creates a JSON request to courier on behalf of the passed in client, carrying the ID
+// of the request which opened its connection so a conversation can be traced across both services
+func newCourierRequest(ctx context.Context, client *Client, method string, url string, body interface{}) (*http.Request, error) {
+	postBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(postBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if client.RequestID != "" {
+		req.Header.Set(middleware.RequestIDHeader, client.RequestID)
+	}
+	return req, nil
+}
+
+// callCourier makes the passed in request to courier, recording the exchange to our audit sink
+func callCourier(client *Client, req *http.Request) (*utils.RequestResponse, error) {
+	rr, err := utils.MakeHTTPRequest(req)
+	client.hub.audit(client, rr)
+	if err != nil {
+		if rr != nil && rr.StatusCode != 0 {
+			return rr, &courierError{statusCode: rr.StatusCode, reason: courierReason(rr)}
+		}
+		return rr, &courierError{reason: err.Error()}
+	}
+	return rr, nil
+}
+
+// courierError is an error or unexpected response from courier
+type courierError struct {
+	statusCode int
+	reason     string
+}
+
+func (e *courierError) Error() string {
+	if e.statusCode != 0 {
+		return fmt.Sprintf("courier request failed with status %d: %s", e.statusCode, e.reason)
+	}
+	return "courier request failed: " + e.reason
+}
+
+// courierReason returns the message courier gave in the body of the passed in failed response
+func courierReason(rr *utils.RequestResponse) string {
+	reason := &struct {
+		Message string `json:"message"`
+	}{}
+	_ = json.Unmarshal(rr.Body, reason)
+	return reason.Message
+}
+
+// decodeCourierResponse decodes and validates the body of the passed in courier response into the passed in
+// response model, returning a courierError if courier failed or sent something we can't use
+func decodeCourierResponse(rr *utils.RequestResponse, response interface{}) error {
+	if rr.Status != utils.RRStatusSuccess {
+		return &courierError{statusCode: rr.StatusCode, reason: courierReason(rr)}
+	}
+
+	err := json.Unmarshal(rr.Body, response)
+	if err != nil {
+		return &courierError{reason: "invalid response: " + err.Error()}
+	}
+	err = utils.Validate(response)
+	if err != nil {
+		return &courierError{reason: "invalid response: " + strings.Join(utils.ErrorDetails(err), ", ")}
+	}
+	return nil
+}
+
 type WSMessage struct {
 	CID   int             `json:"cid"`
 	Event string          `json:"event"`
 	Data  json.RawMessage `json:"data"`
 }
 
-func HandleHandshakeMsg(client *Client, msg *WSMessage) error {
-	client.send <- map[string]interface{}{
+type HandshakeRequest struct {
+	OutboundFormat string `json:"outboundFormat"`
+	SessionToken   string `json:"sessionToken"`
+}
+
+func HandleHandshakeMsg(ctx context.Context, client *Client, msg *WSMessage) error {
+	// widgets may ask for the format messages are sent in, older ones don't and get our default
+	reqData := &HandshakeRequest{}
+	if len(msg.Data) > 0 {
+		_ = json.Unmarshal(msg.Data, reqData)
+	}
+	if isOutboundFormat(reqData.OutboundFormat) {
+		client.setOutboundFormat(reqData.OutboundFormat)
+	}
+
+	// widgets reconnecting within our grace period pick up where they left off, repeat handshakes keep the session
+	// they already have unless they resume another
+	var resumed *session
+	if client.hub.sessionGracePeriod() > 0 && client.featureEnabled(FeatureSessionResume) {
+		if reqData.SessionToken != "" {
+			resumed = client.hub.sessions.resume(reqData.SessionToken)
+		}
+		if resumed != nil {
+			client.hub.sessions.discard(client.sessionToken)
+			client.resumeSession(resumed, !isOutboundFormat(reqData.OutboundFormat))
+		} else if client.sessionToken == "" {
+			client.sessionToken = client.hub.sessions.create(client)
+		}
+	}
+
+	client.sendMessage(ctx, map[string]interface{}{
 		"rid": msg.CID,
 		"data": map[string]interface{}{
 			"id":              client.Id,
-			"pingTimeout":     20000,
+			"pingTimeout":     client.hub.pingTimeout().Milliseconds(),
 			"isAuthenticated": false,
+			"outboundFormat":  client.OutboundFormat(),
+			"language":        client.Language().String(),
+			"sessionToken":    client.sessionToken,
+			"sessionResumed":  resumed != nil,
 		},
+	})
+
+	// only once the widget knows it resumed do we send it what it missed
+	if resumed != nil {
+		client.hub.resume <- &resumeRequest{client: client, buffered: resumed.buffered}
 	}
 	return nil
 }
@@ -33,74 +148,109 @@ type RegisterRequest struct {
 
 type RegisterResponse struct {
 	Message string                 `json:"message"`
-	Data    []RegisterResponseData `json:"data"`
+	Data    []RegisterResponseData `json:"data" validate:"required,min=1,dive"`
 }
 type RegisterResponseData struct {
-	ContactUUID  string `json:"contact_uuid"`
-	ContactToken string `json:"contact_token"`
-	ContactUrn   string `json:"contact_urn"`
+	ContactUUID  string `json:"contact_uuid"  validate:"required"`
+	ContactToken string `json:"contact_token" validate:"required"`
+	ContactUrn   string `json:"contact_urn"   validate:"required"`
 }
 
-func HandleRegisterUser(client *Client, msg *WSMessage) error {
+func HandleRegisterUser(ctx context.Context, client *Client, msg *WSMessage) error {
 	reqData := &RegisterRequest{}
 	err := json.Unmarshal(msg.Data, reqData)
 	if err != nil {
 		return err
 	}
 
-	registerUrl := fmt.Sprintf("%s/c/wch/%s/register", client.HostApi, client.ChannelUUID)
-	postBody, _ := json.Marshal(map[string]string{
-		"urn":        client.Id,
-		"user_token": client.UserToken,
-		"language":   utils.GetLanguage(reqData.Language),
-	})
-	req, _ := http.NewRequest(http.MethodPost, registerUrl, bytes.NewReader(postBody))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	rr, err := utils.MakeHTTPRequest(req)
-	if err != nil {
-		return err
+	// the language the widget registers with takes precedence over the one we negotiated when it connected
+	if reqData.Language != "" {
+		client.negotiateLanguage(reqData.Language)
 	}
 
-	registerResponse := &RegisterResponse{}
-	err = json.Unmarshal(rr.Body, registerResponse)
+	// repeat registrations by the same visitor get the contact courier already created for them, with the language
+	// the widget asked for as the languages we translate our own text into needn't be those of the contact's flows
+	ttl := time.Duration(client.hub.Config().RegistrationCacheTTL) * time.Second
+	contact, cached, err := client.hub.registrations.get(registrationKey(client), ttl, func() (RegisterResponseData, error) {
+		return registerWithCourier(ctx, client, utils.GetLanguage(reqData.Language))
+	})
 	if err != nil {
 		return err
 	}
+	client.Log().WithField("cached", cached).WithField("contact_uuid", contact.ContactUUID).Debugln("Registered user")
+	client.contactURN = contact.ContactUrn
+	client.hub.sessions.setContactURN(client, contact.ContactUrn)
 
 	response := map[string]string{
-		"urn":   registerResponse.Data[0].ContactUrn,
-		"uuid":  registerResponse.Data[0].ContactUUID,
-		"token": registerResponse.Data[0].ContactToken,
+		"urn":   contact.ContactUrn,
+		"uuid":  contact.ContactUUID,
+		"token": contact.ContactToken,
 	}
 	responseEncoded, err := json.Marshal(response)
 	if err != nil {
 		return err
 	}
-	client.send <- map[string]interface{}{
+	client.sendMessage(ctx, map[string]interface{}{
 		"rid":   msg.CID,
 		"error": string(responseEncoded),
+	})
+
+	// only contacts we have never greeted are new, however often they register or their cached registration expires
+	if !cached && client.channel.hasGreeting() && client.hub.isNewContact(contact) {
+		startConversation(ctx, client, contact)
 	}
 	return nil
 }
 
+// registerWithCourier registers the passed in client as a contact with courier, returning that contact
+func registerWithCourier(ctx context.Context, client *Client, language string) (RegisterResponseData, error) {
+	registerUrl := fmt.Sprintf("%s/c/wch/%s/register", client.HostApi, client.ChannelUUID)
+	req, err := newCourierRequest(ctx, client, http.MethodPost, registerUrl, map[string]string{
+		"urn":        client.Id,
+		"user_token": client.UserToken,
+		"language":   language,
+	})
+	if err != nil {
+		return RegisterResponseData{}, err
+	}
+	rr, err := callCourier(client, req)
+	if err != nil {
+		return RegisterResponseData{}, err
+	}
+
+	registerResponse := &RegisterResponse{}
+	err = decodeCourierResponse(rr, registerResponse)
+	if err != nil {
+		return RegisterResponseData{}, err
+	}
+	return registerResponse.Data[0], nil
+}
+
+// GetHistoryRequest asks for a contact's history. Widgets that send none of the paging fields get all of it as
+// a list of messages, others get a historyPage with the cursor of the next page.
 type GetHistoryRequest struct {
 	UserToken string `json:"userToken"`
+	Before    string `json:"before"`
+	After     string `json:"after"`
+	SinceID   string `json:"sinceId"`
+	Limit     int    `json:"limit"`
 }
 
 type GetHistoryResponse struct {
 	Message string                     `json:"message"`
-	Data    [][]GetHistoryResponseData `json:"data"`
+	Data    [][]GetHistoryResponseData `json:"data" validate:"required,min=1"`
+	Next    string                     `json:"next"`
 }
 
 type GetHistoryResponseData struct {
+	ID          HistoryID   `json:"id,omitempty"`
 	Message     string      `json:"message"`
 	Origin      string      `json:"origin"`
 	Metadata    interface{} `json:"metadata"`
 	Attachments interface{} `json:"attachments"`
 }
 
-func HandleGetHistory(client *Client, msg *WSMessage) error {
+func HandleGetHistory(ctx context.Context, client *Client, msg *WSMessage) error {
 	reqData := &GetHistoryRequest{}
 	err := json.Unmarshal(msg.Data, reqData)
 	if err != nil {
@@ -110,60 +260,179 @@ func HandleGetHistory(client *Client, msg *WSMessage) error {
 	if reqData.UserToken != client.UserToken {
 		return errors.New("Tokens do not match. ")
 	}
+	if !client.featureEnabled(FeatureHistory) {
+		return errors.New("history is disabled for this channel")
+	}
+	config := client.hub.Config()
+	paged := reqData.isPaged()
+	if paged {
+		err = reqData.normalize(config.HistoryPageSize, config.HistoryMaxPageSize)
+		if err != nil {
+			return err
+		}
+	}
 
-	getHistoryUrl := fmt.Sprintf("%s/c/wch/%s/history", client.HostApi, client.ChannelUUID)
-	postBody, _ := json.Marshal(map[string]string{"user_token": client.UserToken})
-	req, _ := http.NewRequest(http.MethodPost, getHistoryUrl, bytes.NewReader(postBody))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	rr, err := utils.MakeHTTPRequest(req)
+	msgs, next, courierPaged, err := loadHistory(ctx, client, reqData, paged)
 	if err != nil {
 		return err
 	}
 
-	historyResponse := &GetHistoryResponse{}
-	err = json.Unmarshal(rr.Body, historyResponse)
-	if err != nil {
-		return err
+	if msgs == nil {
+		msgs = []GetHistoryResponseData{}
+	}
+	var response interface{} = msgs
+	if paged {
+		response, err = pageHistory(msgs, reqData, next, courierPaged)
+		if err != nil {
+			return err
+		}
 	}
 
-	responseEncoded, err := json.Marshal(historyResponse.Data[0])
+	responseEncoded, err := json.Marshal(response)
 	if err != nil {
 		return err
 	}
-	client.send <- map[string]interface{}{
+	client.sendMessage(ctx, map[string]interface{}{
 		"rid":   msg.CID,
 		"error": string(responseEncoded),
-	}
+	})
 	return nil
 }
 
+// loadHistory returns the history of the passed in client, and if courier paged it as the passed in paged asks,
+// courier's cursor for the next page. It is served from our history store once that has been backfilled from courier, falling back to courier if
+// the store fails. Courier looks history up by user token, so the store is only used for clients which have
+// registered that token as a contact, under the URN courier gave it.
+func loadHistory(ctx context.Context, client *Client, reqData *GetHistoryRequest, paged bool) ([]GetHistoryResponseData, string, bool, error) {
+	store := client.hub.historyStore
+	urn := client.contactURN
+	if store != nil && urn != "" {
+		msgs, backfilled, err := store.History(urn)
+		if err != nil {
+			client.Log().WithError(err).Error("Failed to read history store, falling back to courier")
+		} else if backfilled {
+			return msgs, "", false, nil
+		}
+	}
+
+	// backfilling needs all of courier's history, which we then page ourselves
+	backfill := store != nil && urn != ""
+	params := reqData.courierParams(client.UserToken)
+	if backfill {
+		params = map[string]interface{}{"user_token": client.UserToken}
+	}
+
+	getHistoryUrl := fmt.Sprintf("%s/c/wch/%s/history", client.HostApi, client.ChannelUUID)
+	req, err := newCourierRequest(ctx, client, http.MethodPost, getHistoryUrl, params)
+	if err != nil {
+		return nil, "", false, err
+	}
+	rr, err := callCourier(client, req)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	historyResponse := &GetHistoryResponse{}
+	err = decodeCourierResponse(rr, historyResponse)
+	if err != nil {
+		return nil, "", false, err
+	}
+	msgs := historyResponse.Data[0]
+
+	if backfill {
+		err = store.Backfill(urn, msgs)
+		if err != nil {
+			client.Log().WithError(err).Error("Failed to backfill history store")
+			return msgs, "", false, nil
+		}
+
+		// serve what we stored so cursors are our own message ids from now on
+		stored, _, err := store.History(urn)
+		if err == nil {
+			return stored, "", false, nil
+		}
+		return msgs, "", false, nil
+	}
+	return msgs, historyResponse.Next, paged, nil
+}
+
 type SendMessageRequest struct {
 	Text     string `json:"text"`
 	UserURN  string `json:"userUrn"`
 	UserUUID string `json:"userUuid"`
 }
 
-func HandleSendMessageToChannel(client *Client, msg *WSMessage) error {
+func HandleSendMessageToChannel(ctx context.Context, client *Client, msg *WSMessage) error {
 	reqData := &SendMessageRequest{}
 	err := json.Unmarshal(msg.Data, reqData)
 	if err != nil {
 		return err
 	}
 
-	getHistoryUrl := fmt.Sprintf("%s/c/wch/%s/receive", client.HostApi, client.ChannelUUID)
-	postBody, _ := json.Marshal(map[string]string{
+	body := map[string]string{
 		"from":           reqData.UserURN,
 		"text":           reqData.Text,
 		"attachment_url": "",
-	})
-	req, _ := http.NewRequest(http.MethodPost, getHistoryUrl, bytes.NewReader(postBody))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	_, err = utils.MakeHTTPRequest(req)
+	}
+
+	client.hub.mirrorToAgents(ctx, client.UserUrn, conversationEvent(client.UserUrn, senderContact, "", reqData.Text, nil))
+
+	// conversations handed off to an agent aren't sent to courier until they are handed back
+	if client.hub.handoffs.active(client.UserUrn) {
+		client.hub.recordHistory(client.contactURN, GetHistoryResponseData{Message: reqData.Text, Origin: historyOriginUser})
+		return replyMessageStatus(ctx, client, msg, "", msgStatusSent)
+	}
+
+	// messages queue behind any from the same contact still waiting to be retried, to keep them in order
+	outbox := client.hub.outbox
+	if !client.featureEnabled(FeatureOutbox) {
+		outbox = nil
+	}
+	if outbox != nil && outbox.HasPending(client.UserUrn) {
+		return queueInOutbox(ctx, client, msg, body)
+	}
+
+	receiveUrl := fmt.Sprintf("%s/c/wch/%s/receive", client.HostApi, client.ChannelUUID)
+	req, err := newCourierRequest(ctx, client, http.MethodPost, receiveUrl, body)
+	if err != nil {
+		return err
+	}
+	_, err = callCourier(client, req)
 	if err != nil {
+		if outbox != nil && isRetryable(err) {
+			client.Log().WithError(err).Warn("Failed to send message to courier, queueing it for retry")
+			return queueInOutbox(ctx, client, msg, body)
+		}
 		return err
 	}
+
+	client.hub.recordHistory(client.contactURN, GetHistoryResponseData{Message: reqData.Text, Origin: historyOriginUser})
+	return replyMessageStatus(ctx, client, msg, "", msgStatusSent)
+}
+
+// queueInOutbox adds the passed in courier request body to our outbox, letting the client know its message is
+// pending. It is confirmed with a messageStatus event once courier accepts it.
+func queueInOutbox(ctx context.Context, client *Client, msg *WSMessage, body map[string]string) error {
+	id, err := client.hub.outbox.Add(client, body)
+	if err != nil {
+		return err
+	}
+	return replyMessageStatus(ctx, client, msg, id, msgStatusPending)
+}
+
+// replyMessageStatus answers a sendMessageToChannel event with the status of the message
+func replyMessageStatus(ctx context.Context, client *Client, msg *WSMessage, id string, status string) error {
+	if msg.CID == 0 {
+		return nil
+	}
+	responseEncoded, err := json.Marshal(map[string]string{"id": id, "status": status})
+	if err != nil {
+		return err
+	}
+	client.sendMessage(ctx, map[string]interface{}{
+		"rid":   msg.CID,
+		"error": string(responseEncoded),
+	})
 	return nil
 }
 
@@ -171,7 +440,7 @@ type SubscribeRequest struct {
 	Channel string `json:"channel"`
 }
 
-func HandleSubscribe(client *Client, msg *WSMessage) error {
+func HandleSubscribe(ctx context.Context, client *Client, msg *WSMessage) error {
 	reqData := &SubscribeRequest{}
 	err := json.Unmarshal(msg.Data, reqData)
 	if err != nil {
@@ -179,21 +448,22 @@ func HandleSubscribe(client *Client, msg *WSMessage) error {
 	}
 
 	client.UserUrn = reqData.Channel
+	client.addLogField("urn", client.UserUrn)
 	client.hub.register <- client
 	return nil
 }
 
-func HandleWSMessage(client *Client, msg *WSMessage) (error, string) {
+func HandleWSMessage(ctx context.Context, client *Client, msg *WSMessage) (error, string) {
 	if msg.Event == "#handshake" {
-		return HandleHandshakeMsg(client, msg), "Failed to send handshake response message:"
+		return HandleHandshakeMsg(ctx, client, msg), "Failed to send handshake response message:"
 	} else if msg.Event == "registerUser" {
-		return HandleRegisterUser(client, msg), "Failed to process register user:"
+		return HandleRegisterUser(ctx, client, msg), "Failed to process register user:"
 	} else if msg.Event == "getHistory" {
-		return HandleGetHistory(client, msg), "Failed to get history:"
+		return HandleGetHistory(ctx, client, msg), "Failed to get history:"
 	} else if msg.Event == "sendMessageToChannel" {
-		return HandleSendMessageToChannel(client, msg), "Failed to send message:"
+		return HandleSendMessageToChannel(ctx, client, msg), "Failed to send message:"
 	} else if msg.Event == "#subscribe" {
-		return HandleSubscribe(client, msg), "Failed to subscribe:"
+		return HandleSubscribe(ctx, client, msg), "Failed to subscribe:"
 	}
 	return nil, ""
 }
@@ -0,0 +1,167 @@
+package webchat
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+const testChannelUUID = "8eb23e93-5ecb-45ba-b726-3b064e0c56ab"
+
+// panickingHistoryStore is a history store which panics when read, standing in for a handler bug
+type panickingHistoryStore struct{}
+
+func (s *panickingHistoryStore) Append(urn string, msgs ...GetHistoryResponseData) error  { return nil }
+func (s *panickingHistoryStore) Backfill(urn string, msgs []GetHistoryResponseData) error { return nil }
+func (s *panickingHistoryStore) History(urn string) ([]GetHistoryResponseData, bool, error) {
+	panic("history store exploded")
+}
+func (s *panickingHistoryStore) Close() error { return nil }
+
+// assertStillConnected checks the widget's connection survived by handshaking again
+func assertStillConnected(t *testing.T, widget *testWidget) {
+	t.Helper()
+	if response := widget.handshake(`{}`); response["id"] == nil {
+		t.Errorf("expected widget to still be connected, got %v", response)
+	}
+}
+
+// okResponse returns the data of the passed in successful handler reply, which widgets get as a JSON string
+func okResponse(t *testing.T, reply map[string]interface{}, cid int, data interface{}) {
+	t.Helper()
+	if rid, _ := reply["rid"].(float64); int(rid) != cid {
+		t.Fatalf("expected reply to %d, got %v", cid, reply)
+	}
+	encoded, isString := reply["error"].(string)
+	if !isString {
+		t.Fatalf("expected successful reply to %d, got %v", cid, reply)
+	}
+	if err := json.Unmarshal([]byte(encoded), data); err != nil {
+		t.Fatalf("expected JSON in reply to %d, got %s", cid, encoded)
+	}
+}
+
+func TestHandleRegisterUser(t *testing.T) {
+	tcs := []struct {
+		label    string
+		status   int
+		body     string
+		errName  string
+		errorMsg string
+	}{
+		{"registered", 200, `{"message":"ok","data":[{"contact_uuid":"c1","contact_token":"t1","contact_urn":"webchat:1234"}]}`, "", ""},
+		{"empty data", 200, `{"message":"ok","data":[]}`, "CourierError", "Failed to process register user"},
+		{"missing contact fields", 200, `{"message":"ok","data":[{"contact_uuid":"c1"}]}`, "CourierError", "Failed to process register user"},
+		{"courier error with message", 400, `{"message":"channel is inactive"}`, "CourierError", "Failed to process register user"},
+		{"courier down", 503, `upstream unavailable`, "CourierError", "Failed to process register user"},
+		{"invalid JSON", 200, `{"message": "ok", "data": [`, "CourierError", "Failed to process register user"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.label, func(t *testing.T) {
+			courier := newTestCourier(t, map[string]http.HandlerFunc{
+				"/c/wch/" + testChannelUUID + "/register": courierResponse(tc.status, tc.body),
+			})
+			hub := newTestHub(t, nil)
+			widget := connectWidget(t, hub, testChannelUUID, courier.URL)
+			widget.handshake(`{}`)
+
+			widget.send(3, "registerUser", `{"language":"en"}`)
+			reply := widget.read()
+
+			if tc.errName == "" {
+				contact := make(map[string]string)
+				okResponse(t, reply, 3, &contact)
+				if contact["urn"] != "webchat:1234" || contact["uuid"] != "c1" || contact["token"] != "t1" {
+					t.Errorf("unexpected contact in reply: %v", contact)
+				}
+			} else {
+				errObj := replyError(t, reply, 3)
+				if errObj["name"] != tc.errName || errObj["message"] != tc.errorMsg {
+					t.Errorf("expected %s %q, got %v", tc.errName, tc.errorMsg, errObj)
+				}
+			}
+			assertStillConnected(t, widget)
+		})
+	}
+}
+
+func TestHandleGetHistory(t *testing.T) {
+	tcs := []struct {
+		label    string
+		status   int
+		body     string
+		errName  string
+		errorMsg string
+	}{
+		{"history", 200, `{"message":"ok","data":[[{"message":"hi","origin":"user"},{"message":"hello","origin":"chatbot"}]]}`, "", ""},
+		{"empty data", 200, `{"message":"ok","data":[]}`, "CourierError", "Failed to get history"},
+		{"courier error with message", 404, `{"message":"contact not found"}`, "CourierError", "Failed to get history"},
+		{"invalid JSON", 200, `not json`, "CourierError", "Failed to get history"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.label, func(t *testing.T) {
+			courier := newTestCourier(t, map[string]http.HandlerFunc{
+				"/c/wch/" + testChannelUUID + "/history": courierResponse(tc.status, tc.body),
+			})
+			hub := newTestHub(t, nil)
+			widget := connectWidget(t, hub, testChannelUUID, courier.URL)
+			widget.handshake(`{}`)
+
+			widget.send(3, "getHistory", `{"userToken":"token-1"}`)
+			reply := widget.read()
+
+			if tc.errName == "" {
+				msgs := make([]GetHistoryResponseData, 0)
+				okResponse(t, reply, 3, &msgs)
+				if len(msgs) != 2 || msgs[0].Message != "hi" || msgs[1].Origin != "chatbot" {
+					t.Errorf("unexpected history in reply: %v", msgs)
+				}
+			} else {
+				errObj := replyError(t, reply, 3)
+				if errObj["name"] != tc.errName || errObj["message"] != tc.errorMsg {
+					t.Errorf("expected %s %q, got %v", tc.errName, tc.errorMsg, errObj)
+				}
+			}
+			assertStillConnected(t, widget)
+		})
+	}
+
+	t.Run("mismatched token", func(t *testing.T) {
+		hub := newTestHub(t, nil)
+		widget := connectWidget(t, hub, testChannelUUID, "")
+		widget.handshake(`{}`)
+
+		widget.send(3, "getHistory", `{"userToken":"someone-else"}`)
+		errObj := replyError(t, widget.read(), 3)
+		if errObj["name"] != "EventError" {
+			t.Errorf("expected EventError, got %v", errObj)
+		}
+		assertStillConnected(t, widget)
+	})
+}
+
+func TestHandlerPanic(t *testing.T) {
+	courier := newTestCourier(t, map[string]http.HandlerFunc{
+		"/c/wch/" + testChannelUUID + "/register": courierResponse(200, `{"message":"ok","data":[{"contact_uuid":"c1","contact_token":"t1","contact_urn":"webchat:1234"}]}`),
+	})
+	hub := newTestHub(t, nil)
+	hub.SetHistoryStore(&panickingHistoryStore{})
+	widget := connectWidget(t, hub, testChannelUUID, courier.URL)
+	widget.handshake(`{}`)
+
+	widget.send(3, "registerUser", `{}`)
+	widget.read()
+	widget.subscribe(hub, "webchat:1234")
+
+	widget.send(4, "getHistory", `{"userToken":"token-1"}`)
+	errObj := replyError(t, widget.read(), 4)
+	if errObj["name"] != "EventError" || errObj["message"] != "Failed to handle event" {
+		t.Errorf("expected EventError for panic, got %v", errObj)
+	}
+	if hub.Stats().Snapshot().Panics != 1 {
+		t.Errorf("expected panic to be counted, got %d", hub.Stats().Snapshot().Panics)
+	}
+	assertStillConnected(t, widget)
+}
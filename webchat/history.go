@@ -0,0 +1,144 @@
+package webchat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HistoryID is the ID of a message in a contact's history, which courier may send as a number or a string
+type HistoryID string
+
+// UnmarshalJSON reads a history ID from either a JSON number or string
+func (id *HistoryID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = HistoryID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("history id must be a string or number, got %s", data)
+	}
+	*id = HistoryID(n.String())
+	return nil
+}
+
+// historyPage is a page of history returned to widgets which asked for one
+type historyPage struct {
+	Messages []GetHistoryResponseData `json:"messages"`
+	Next     string                   `json:"next"`
+	HasMore  bool                     `json:"hasMore"`
+}
+
+// isPaged returns whether the widget asked for a page of history rather than all of it
+func (r *GetHistoryRequest) isPaged() bool {
+	return r.Before != "" || r.After != "" || r.SinceID != "" || r.Limit != 0
+}
+
+// newer returns whether the widget is paging forward to newer messages rather than back to older ones
+func (r *GetHistoryRequest) newer() bool {
+	return r.After != "" || r.SinceID != ""
+}
+
+// cursor returns the message ID the widget is paging from
+func (r *GetHistoryRequest) cursor() string {
+	if r.SinceID != "" {
+		return r.SinceID
+	}
+	if r.After != "" {
+		return r.After
+	}
+	return r.Before
+}
+
+// normalize checks the paging parameters of the request, defaulting its limit to the passed in page size
+func (r *GetHistoryRequest) normalize(pageSize int, maxPageSize int) error {
+	cursors := 0
+	for _, c := range []string{r.Before, r.After, r.SinceID} {
+		if c != "" {
+			cursors++
+		}
+	}
+	if cursors > 1 {
+		return errors.New("only one of before, after and sinceId can be set")
+	}
+	if r.Limit < 0 || r.Limit > maxPageSize {
+		return fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+
+	if r.Limit == 0 {
+		// widgets catching up on what they missed get as much as we allow
+		if r.SinceID != "" {
+			r.Limit = maxPageSize
+		} else {
+			r.Limit = pageSize
+		}
+	}
+	return nil
+}
+
+// courierParams returns the paging parameters we forward to courier along with the user token
+func (r *GetHistoryRequest) courierParams(userToken string) map[string]interface{} {
+	params := map[string]interface{}{"user_token": userToken}
+	if r.isPaged() {
+		params["limit"] = r.Limit
+		if r.newer() {
+			params["after"] = r.cursor()
+		} else if r.Before != "" {
+			params["before"] = r.Before
+		}
+	}
+	return params
+}
+
+// pageHistory cuts the page the passed in request asked for out of the passed in messages, oldest first. Courier
+// may already have paged them, in which case this is a no-op apart from working out the next cursor. Otherwise
+// the messages are all of the history, so a cursor which isn't one of them is an error.
+func pageHistory(msgs []GetHistoryResponseData, r *GetHistoryRequest, courierNext string, courierPaged bool) (*historyPage, error) {
+	// drop everything up to and including our cursor, if courier sent it back
+	if cursor := r.cursor(); cursor != "" {
+		found := false
+		for i, m := range msgs {
+			if strings.EqualFold(string(m.ID), cursor) {
+				if r.newer() {
+					msgs = msgs[i+1:]
+				} else {
+					msgs = msgs[:i]
+				}
+				found = true
+				break
+			}
+		}
+		if !found && !courierPaged {
+			return nil, fmt.Errorf("no message in history with id %s", cursor)
+		}
+	}
+
+	hasMore := courierNext != ""
+	if len(msgs) > r.Limit {
+		hasMore = true
+		if r.newer() {
+			msgs = msgs[:r.Limit]
+		} else {
+			msgs = msgs[len(msgs)-r.Limit:]
+		}
+	}
+
+	page := &historyPage{Messages: msgs, HasMore: hasMore}
+	if hasMore {
+		page.Next = courierNext
+		if page.Next == "" && len(msgs) > 0 {
+			if r.newer() {
+				page.Next = string(msgs[len(msgs)-1].ID)
+			} else {
+				page.Next = string(msgs[0].ID)
+			}
+		}
+	}
+	if page.Messages == nil {
+		page.Messages = []GetHistoryResponseData{}
+	}
+	return page, nil
+}
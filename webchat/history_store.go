@@ -0,0 +1,248 @@
+package webchat
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	server "github.com/greatnonprofits-nfp/websocket-go"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// historyOriginChannel is the origin of messages sent to a contact by the channel
+	historyOriginChannel = "chatbot"
+
+	// historyOriginUser is the origin of messages sent by a contact
+	historyOriginUser = "user"
+)
+
+var (
+	historyBucket    = []byte("history")
+	backfilledBucket = []byte("backfilled")
+)
+
+// HistoryStore keeps the conversation history of each URN so it can be served without asking courier
+type HistoryStore interface {
+	// Append records the passed in messages at the end of the history of the passed in URN
+	Append(urn string, msgs ...GetHistoryResponseData) error
+
+	// Backfill replaces the history of the passed in URN with the passed in messages fetched from courier
+	Backfill(urn string, msgs []GetHistoryResponseData) error
+
+	// History returns the history of the passed in URN, oldest first, and whether it has been backfilled from
+	// courier and so is complete
+	History(urn string) ([]GetHistoryResponseData, bool, error)
+
+	Close() error
+}
+
+// storedMessage is a message in a history store along with when it was stored, for our retention policy
+type storedMessage struct {
+	GetHistoryResponseData
+	StoredOn time.Time `json:"stored_on"`
+}
+
+// boltHistoryStore is a HistoryStore backed by a BoltDB file, keeping a bucket for each URN keyed by sequence
+type boltHistoryStore struct {
+	db        *bolt.DB
+	retention time.Duration
+	stop      chan bool
+	logger    *logrus.Entry
+}
+
+// NewBoltHistoryStore opens or creates the BoltDB history store at the passed in path, removing messages
+// older than the passed in retention period every hour unless it is 0
+func NewBoltHistoryStore(path string, retention time.Duration) (HistoryStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening history store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(historyBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(backfilledBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating history store buckets: %w", err)
+	}
+
+	s := &boltHistoryStore{
+		db:        db,
+		retention: retention,
+		stop:      make(chan bool),
+		logger:    logrus.WithField("comp", "history_store"),
+	}
+	if retention > 0 {
+		go s.expireLoop(time.Hour)
+	}
+	return s, nil
+}
+
+// NewHistoryStore creates the history store the passed in config asks for, returning nil if it asks for none
+func NewHistoryStore(config *server.Config) (HistoryStore, error) {
+	switch config.HistoryStore {
+	case "":
+		return nil, nil
+	case "bolt":
+		return NewBoltHistoryStore(config.HistoryStorePath, time.Duration(config.HistoryRetention)*24*time.Hour)
+	}
+	return nil, fmt.Errorf("unknown history store: %s", config.HistoryStore)
+}
+
+// storedHistoryID returns the ID of the message stored with the passed in sequence, prefixed so it can't be
+// mistaken for one of courier's IDs by widgets paging history served by courier when the store fails
+func storedHistoryID(seq uint64) HistoryID {
+	return HistoryID("s" + strconv.FormatUint(seq, 10))
+}
+
+// sequenceKey returns the bucket key of the passed in sequence, big endian so keys sort oldest first
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// append writes the passed in messages to the passed in URN bucket, giving each the next ID of its sequence
+func appendMessages(bucket *bolt.Bucket, msgs []GetHistoryResponseData, now time.Time) error {
+	for _, msg := range msgs {
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		msg.ID = storedHistoryID(seq)
+
+		value, err := json.Marshal(&storedMessage{GetHistoryResponseData: msg, StoredOn: now})
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(sequenceKey(seq), value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltHistoryStore) Append(urn string, msgs ...GetHistoryResponseData) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(urn))
+		if err != nil {
+			return err
+		}
+		return appendMessages(bucket, msgs, time.Now())
+	})
+}
+
+func (s *boltHistoryStore) Backfill(urn string, msgs []GetHistoryResponseData) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		history := tx.Bucket(historyBucket)
+
+		// courier's history includes anything we have recorded ourselves so it replaces it, keeping our sequence
+		// going so IDs already handed out to widgets aren't reused
+		var seq uint64
+		if existing := history.Bucket([]byte(urn)); existing != nil {
+			seq = existing.Sequence()
+			if err := history.DeleteBucket([]byte(urn)); err != nil {
+				return err
+			}
+		}
+		bucket, err := history.CreateBucket([]byte(urn))
+		if err != nil {
+			return err
+		}
+		if err := bucket.SetSequence(seq); err != nil {
+			return err
+		}
+		if err := appendMessages(bucket, msgs, time.Now()); err != nil {
+			return err
+		}
+
+		return tx.Bucket(backfilledBucket).Put([]byte(urn), []byte(time.Now().Format(time.RFC3339)))
+	})
+}
+
+func (s *boltHistoryStore) History(urn string) ([]GetHistoryResponseData, bool, error) {
+	var msgs []GetHistoryResponseData
+	backfilled := false
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		backfilled = tx.Bucket(backfilledBucket).Get([]byte(urn)) != nil
+
+		bucket := tx.Bucket(historyBucket).Bucket([]byte(urn))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			stored := &storedMessage{}
+			if err := json.Unmarshal(v, stored); err != nil {
+				return err
+			}
+
+			// IDs are always those of their keys, whatever was stored with them
+			stored.ID = storedHistoryID(binary.BigEndian.Uint64(k))
+			msgs = append(msgs, stored.GetHistoryResponseData)
+			return nil
+		})
+	})
+	return msgs, backfilled, err
+}
+
+// expire removes every message stored before the passed in time
+func (s *boltHistoryStore) expire(before time.Time) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).ForEachBucket(func(urn []byte) error {
+			c := tx.Bucket(historyBucket).Bucket(urn).Cursor()
+
+			// messages are in the order they were stored so we can stop at the first one we keep
+			for k, v := c.First(); k != nil; k, v = c.First() {
+				stored := &storedMessage{}
+				if err := json.Unmarshal(v, stored); err != nil {
+					return err
+				}
+				if !stored.StoredOn.Before(before) {
+					break
+				}
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				removed++
+			}
+			return nil
+		})
+	})
+	return removed, err
+}
+
+// expireLoop applies our retention policy at the passed in interval until we are closed
+func (s *boltHistoryStore) expireLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := s.expire(time.Now().Add(-s.retention))
+		if err != nil {
+			s.logger.WithError(err).Error("error expiring history")
+		} else if removed > 0 {
+			s.logger.WithField("removed", removed).Info("expired history")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *boltHistoryStore) Close() error {
+	close(s.stop)
+	return s.db.Close()
+}
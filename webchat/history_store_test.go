@@ -0,0 +1,79 @@
+package webchat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestHistoryStore opens a BoltDB history store in a temporary directory
+func newTestHistoryStore(t *testing.T) HistoryStore {
+	store, err := NewBoltHistoryStore(filepath.Join(t.TempDir(), "history.db"), 0)
+	if err != nil {
+		t.Fatalf("error opening history store: %s", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// historyIDs returns the IDs of the passed in messages
+func historyIDs(msgs []GetHistoryResponseData) []string {
+	ids := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, string(m.ID))
+	}
+	return ids
+}
+
+func TestBoltHistoryStore(t *testing.T) {
+	store := newTestHistoryStore(t)
+
+	if err := store.Append("webchat:1234", GetHistoryResponseData{ID: "99", Message: "hi", Origin: historyOriginUser}); err != nil {
+		t.Fatalf("error appending: %s", err)
+	}
+	msgs, backfilled, err := store.History("webchat:1234")
+	if err != nil || backfilled || strings.Join(historyIDs(msgs), ",") != "s1" {
+		t.Fatalf("expected one unbackfilled message with our own ID, got %v %v %v", historyIDs(msgs), backfilled, err)
+	}
+
+	// backfilling replaces what we recorded with courier's history, continuing our sequence
+	err = store.Backfill("webchat:1234", []GetHistoryResponseData{{ID: "1", Message: "hi"}, {ID: "2", Message: "hello"}})
+	if err != nil {
+		t.Fatalf("error backfilling: %s", err)
+	}
+	_ = store.Append("webchat:1234", GetHistoryResponseData{Message: "bye"})
+
+	msgs, backfilled, err = store.History("webchat:1234")
+	if err != nil || !backfilled || strings.Join(historyIDs(msgs), ",") != "s2,s3,s4" || msgs[2].Message != "bye" {
+		t.Fatalf("expected backfilled history with our own IDs, got %v %v %v", historyIDs(msgs), backfilled, err)
+	}
+
+	// other URNs have their own history
+	msgs, backfilled, _ = store.History("webchat:5678")
+	if len(msgs) != 0 || backfilled {
+		t.Errorf("expected no history for another URN, got %v", msgs)
+	}
+}
+
+func TestMessageReceivedRecordsHistory(t *testing.T) {
+	hub := newTestHub(t, nil)
+	store := newTestHistoryStore(t)
+	hub.SetHistoryStore(store)
+
+	// messages are recorded even for contacts who aren't connected to receive them
+	body := `{"id":"m1","text":"while you were away","to":"webchat:1234"}`
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	MessageReceived(hub, w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for contact not connected, got %d", w.Code)
+	}
+
+	msgs, _, _ := store.History("webchat:1234")
+	if len(msgs) != 1 || msgs[0].Message != "while you were away" || msgs[0].Origin != historyOriginChannel {
+		t.Errorf("expected message to be recorded, got %v", msgs)
+	}
+}
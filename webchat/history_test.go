@@ -0,0 +1,87 @@
+package webchat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPageHistory(t *testing.T) {
+	msgs := make([]GetHistoryResponseData, 0)
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		msgs = append(msgs, GetHistoryResponseData{ID: HistoryID(id), Message: "msg " + id})
+	}
+
+	tcs := []struct {
+		label        string
+		request      GetHistoryRequest
+		courierNext  string
+		courierPaged bool
+		ids          []string
+		next         string
+		hasMore      bool
+		err          string
+	}{
+		{"latest page", GetHistoryRequest{Limit: 2}, "", false, []string{"4", "5"}, "4", true, ""},
+		{"all fits", GetHistoryRequest{Limit: 10}, "", false, []string{"1", "2", "3", "4", "5"}, "", false, ""},
+		{"before", GetHistoryRequest{Before: "5", Limit: 2}, "", false, []string{"3", "4"}, "3", true, ""},
+		{"before oldest page", GetHistoryRequest{Before: "3", Limit: 2}, "", false, []string{"1", "2"}, "", false, ""},
+		{"before first", GetHistoryRequest{Before: "1", Limit: 2}, "", false, []string{}, "", false, ""},
+		{"after", GetHistoryRequest{After: "2", Limit: 2}, "", false, []string{"3", "4"}, "4", true, ""},
+		{"since", GetHistoryRequest{SinceID: "4", Limit: 10}, "", false, []string{"5"}, "", false, ""},
+		{"since latest", GetHistoryRequest{SinceID: "5", Limit: 10}, "", false, []string{}, "", false, ""},
+		{"unknown before", GetHistoryRequest{Before: "9", Limit: 2}, "", false, nil, "", false, "no message in history with id 9"},
+		{"unknown after", GetHistoryRequest{After: "9", Limit: 2}, "", false, nil, "", false, "no message in history with id 9"},
+		{"unknown since", GetHistoryRequest{SinceID: "9", Limit: 10}, "", false, nil, "", false, "no message in history with id 9"},
+		{"courier paged", GetHistoryRequest{Before: "9", Limit: 5}, "c-next", true, []string{"1", "2", "3", "4", "5"}, "c-next", true, ""},
+		{"courier paged last page", GetHistoryRequest{After: "0", Limit: 5}, "", true, []string{"1", "2", "3", "4", "5"}, "", false, ""},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.label, func(t *testing.T) {
+			page, err := pageHistory(msgs, &tc.request, tc.courierNext, tc.courierPaged)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			ids := make([]string, 0)
+			for _, m := range page.Messages {
+				ids = append(ids, string(m.ID))
+			}
+			if !reflect.DeepEqual(ids, tc.ids) || page.Next != tc.next || page.HasMore != tc.hasMore {
+				t.Errorf("expected %v next %q more %v, got %v next %q more %v", tc.ids, tc.next, tc.hasMore, ids, page.Next, page.HasMore)
+			}
+		})
+	}
+}
+
+func TestNormalizeHistoryRequest(t *testing.T) {
+	tcs := []struct {
+		request GetHistoryRequest
+		limit   int
+		err     bool
+	}{
+		{GetHistoryRequest{}, 50, false},
+		{GetHistoryRequest{Before: "3"}, 50, false},
+		{GetHistoryRequest{SinceID: "3"}, 200, false},
+		{GetHistoryRequest{Limit: 10}, 10, false},
+		{GetHistoryRequest{Limit: 201}, 0, true},
+		{GetHistoryRequest{Limit: -1}, 0, true},
+		{GetHistoryRequest{Before: "3", After: "1"}, 0, true},
+	}
+
+	for _, tc := range tcs {
+		request := tc.request
+		err := request.normalize(50, 200)
+		if tc.err != (err != nil) {
+			t.Errorf("%+v: expected error %v, got %v", tc.request, tc.err, err)
+		} else if err == nil && request.Limit != tc.limit {
+			t.Errorf("%+v: expected limit %d, got %d", tc.request, tc.limit, request.Limit)
+		}
+	}
+}
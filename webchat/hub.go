@@ -1,40 +1,402 @@
 package webchat
 
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	server "github.com/greatnonprofits-nfp/websocket-go"
+	"github.com/greatnonprofits-nfp/websocket-go/utils"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
 type HubMessage struct {
+	ctx    context.Context
 	client string
-	msg    interface{}
+	msgs   []interface{}
+	status chan RouteStatus
 }
 
+// RouteStatus is what happened to a message routed by the hub
+type RouteStatus int
+
+const (
+	// RouteNotConnected means no client is subscribed to the message's URN
+	RouteNotConnected RouteStatus = iota
+
+	// RouteDelivered means the message was queued for the client subscribed to its URN
+	RouteDelivered
+
+	// RouteBuffered means the message was kept for a disconnected client which may still resume its session
+	RouteBuffered
+
+	// RouteUnconfirmed means the message was queued but the hub didn't route it in time for us to say what
+	// happened to it, it will still be routed
+	RouteUnconfirmed
+)
+
+// reached returns whether a message with this status was delivered to, or kept for, the client of its URN
+func (s RouteStatus) reached() bool {
+	return s == RouteDelivered || s == RouteBuffered
+}
+
+// resumeRequest asks the hub to attach a client which resumed a session, sending it the messages buffered for it
+type resumeRequest struct {
+	client   *Client
+	buffered []*outboundMessage
+}
+
+// ErrHubOverloaded is returned when the hub can't accept a message in time
+var ErrHubOverloaded = errors.New("hub is overloaded")
+
+// hubReplyTimeout is how long we wait for the hub to route a message before considering it overloaded
+var hubReplyTimeout = 5 * time.Second
+
 type Hub struct {
-	clients    map[string]*Client // clients available by ID
-	register   chan *Client
-	unregister chan *Client
-	receive    chan *HubMessage
+	config    atomic.Value
+	locales   atomic.Value // *locales
+	stats     *Stats
+	upgrader  *websocket.Upgrader
+	agents    *websocket.Upgrader
+	logger    *logrus.Logger
+	auditSink AuditSink
+
+	channels     *ChannelRegistry
+	historyStore HistoryStore
+	greetings    GreetingStore
+	outbox       *Outbox
+
+	clients       map[string]*Client // clients available by ID
+	sessions      *sessionStore
+	registrations *registrationCache
+	register      chan *Client
+	unregister    chan *Client
+	resume        chan *resumeRequest
+	presence      *presenceStore
+	presenceHooks chan *presence
+	watchers      map[string]map[*Client]bool // agents watching each URN
+	handoffs      *handoffStore
+	watch         chan *watchRequest
+	mirror        chan *mirrorMessage
+	receive       chan *HubMessage
+}
+
+// NewHub creates a new Hub for the passed in configuration which logs to the standard logger
+func NewHub(config *server.Config) *Hub {
+	return NewHubWithLogger(config, logrus.StandardLogger())
+}
+
+// NewHubWithLogger creates a new Hub for the passed in configuration which logs to the passed in logger
+func NewHubWithLogger(config *server.Config, logger *logrus.Logger) *Hub {
+	hub := &Hub{
+		logger:        logger,
+		stats:         &Stats{},
+		clients:       make(map[string]*Client),
+		sessions:      newSessionStore(),
+		registrations: newRegistrationCache(),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		resume:        make(chan *resumeRequest),
+		presence:      newPresenceStore(),
+		presenceHooks: make(chan *presence, presenceHookQueueSize),
+		watchers:      make(map[string]map[*Client]bool),
+		handoffs:      newHandoffStore(),
+		watch:         make(chan *watchRequest),
+		mirror:        make(chan *mirrorMessage),
+		receive:       make(chan *HubMessage, config.HubQueueSize),
+	}
+	hub.config.Store(config)
+	locales, err := newLocales(config.Languages, "")
+	if err != nil {
+		locales, _ = newLocales("", "")
+	}
+	hub.locales.Store(locales)
+	hub.upgrader = hub.newUpgrader(hub.checkOrigin)
+	hub.agents = hub.newUpgrader(hub.checkAgentOrigin)
+	hub.channels = newChannelRegistry(hub)
+	return hub
+}
+
+// Channels returns our registry of channel definitions
+func (h *Hub) Channels() *ChannelRegistry {
+	return h.channels
+}
+
+// SetHistoryStore sets the store conversation history is recorded to and served from, it must be called before
+// the hub is used
+func (h *Hub) SetHistoryStore(store HistoryStore) {
+	h.historyStore = store
+}
+
+// SetGreetingStore sets the store which records which contacts have been greeted, it must be called before the
+// hub is used
+func (h *Hub) SetGreetingStore(store GreetingStore) {
+	h.greetings = store
+}
+
+// SetOutbox sets the outbox messages which couldn't be sent to courier are retried from, it must be called
+// before the hub is used
+func (h *Hub) SetOutbox(outbox *Outbox) {
+	h.outbox = outbox
+}
+
+// recordHistory appends the passed in messages to the history of the passed in URN, if we have a history store
+func (h *Hub) recordHistory(urn string, msgs ...GetHistoryResponseData) {
+	if h.historyStore == nil || urn == "" {
+		return
+	}
+	if err := h.historyStore.Append(urn, msgs...); err != nil {
+		h.logger.WithField("comp", "hub").WithField("urn", urn).WithError(err).Error("error recording history")
+	}
+}
+
+// SetAuditSink sets the sink courier exchanges are recorded to, it must be called before the hub is used
+func (h *Hub) SetAuditSink(sink AuditSink) {
+	h.auditSink = sink
+}
+
+// Config returns the current config of the hub
+func (h *Hub) Config() *server.Config {
+	return h.config.Load().(*server.Config)
+}
+
+// SetConfig replaces the config of the hub, settings are read from it as they are needed so changes apply
+// to connected clients without dropping them
+func (h *Hub) SetConfig(config *server.Config) {
+	h.config.Store(config)
+}
+
+// newUpgrader creates a websocket upgrader for our config which checks origins with the passed in function, all
+// connections it upgrades share a single pool of write buffers so idle connections don't each hold on to one
+func (h *Hub) newUpgrader(checkOrigin func(r *http.Request) bool) *websocket.Upgrader {
+	config := h.Config()
+	return &websocket.Upgrader{
+		ReadBufferSize:    config.WSReadBufferSize,
+		WriteBufferSize:   config.WSWriteBufferSize,
+		WriteBufferPool:   &sync.Pool{},
+		EnableCompression: config.WSEnableCompression,
+		HandshakeTimeout:  time.Duration(config.WSHandshakeTimeout) * time.Second,
+		CheckOrigin:       checkOrigin,
+	}
+}
+
+// checkOrigin returns whether the origin of the passed in request is one of our allowed origins
+func (h *Hub) checkOrigin(r *http.Request) bool {
+	allowed := utils.SplitList(h.Config().AllowedOrigins)
+
+	// channels can have their own allowed origins which replace ours
+	if channel := h.channels.Get(r.URL.Query().Get("channelUUID")); channel != nil && len(channel.AllowedOrigins) > 0 {
+		allowed = channel.AllowedOrigins
+	}
+	return originAllowed(r, allowed)
+}
+
+// checkAgentOrigin returns whether the origin of the passed in agent request is one of our allowed agent origins,
+// which are separate from those of widgets as agent consoles are served from their own origins
+func (h *Hub) checkAgentOrigin(r *http.Request) bool {
+	return originAllowed(r, utils.SplitList(h.Config().AgentAllowedOrigins))
+}
+
+// originAllowed returns whether the origin of the passed in request is one of the passed in origins, any origin
+// being allowed if there are none
+func originAllowed(r *http.Request, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	for _, o := range allowed {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[string]*Client),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		receive:    make(chan *HubMessage),
+// checkCourierHost returns whether the passed in host API is one of the courier hosts clients may use
+func (h *Hub) checkCourierHost(hostAPI string) bool {
+	allowed := utils.SplitList(h.Config().CourierHosts)
+	if len(allowed) == 0 {
+		return true
+	}
+
+	hostURL, err := url.Parse(hostAPI)
+	if err != nil {
+		return false
+	}
+	for _, host := range allowed {
+		if strings.EqualFold(host, hostURL.Host) || strings.EqualFold(host, hostAPI) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionGracePeriod returns how long the session of a disconnected client can be resumed for, 0 meaning sessions
+// can't be resumed
+func (h *Hub) sessionGracePeriod() time.Duration {
+	return time.Duration(h.Config().SessionGracePeriod) * time.Second
+}
+
+// pingInterval returns how often clients are sent a SocketCluster ping
+func (h *Hub) pingInterval() time.Duration {
+	return time.Duration(h.Config().WSPingInterval) * time.Second
+}
+
+// pingTimeout returns how long a client may stay silent before it is considered dead
+func (h *Hub) pingTimeout() time.Duration {
+	return time.Duration(h.Config().WSPingTimeout) * time.Second
+}
+
+// Stats returns the counters of websocket events seen by this hub
+func (h *Hub) Stats() *Stats {
+	return h.stats
+}
+
+// Deliver routes the passed in messages to the client subscribed to the passed in URN, returning what happened
+// to them. ErrHubOverloaded is returned if the hub's queue is full, RouteUnconfirmed if it doesn't route them
+// in time.
+func (h *Hub) Deliver(ctx context.Context, urn string, msgs ...interface{}) (RouteStatus, error) {
+	hubMsg, err := h.enqueue(ctx, urn, msgs...)
+	if err != nil {
+		return RouteNotConnected, err
+	}
+
+	deadline, cancel := context.WithTimeout(context.Background(), hubReplyTimeout)
+	defer cancel()
+	return hubMsg.wait(deadline.Done()), nil
+}
+
+// enqueue queues the passed in messages to be routed to the client subscribed to the passed in URN without
+// waiting for them to be routed, ErrHubOverloaded is returned if our queue is full
+func (h *Hub) enqueue(ctx context.Context, urn string, msgs ...interface{}) (*HubMessage, error) {
+	hubMsg := &HubMessage{ctx: ctx, client: urn, msgs: msgs, status: make(chan RouteStatus, 1)}
+
+	select {
+	case h.receive <- hubMsg:
+		return hubMsg, nil
+	default:
+		return nil, ErrHubOverloaded
+	}
+}
+
+// enqueueBefore queues the passed in messages like enqueue, but waits for room in our queue until the passed in
+// timeout rather than giving up straight away when it is full
+func (h *Hub) enqueueBefore(ctx context.Context, timeout <-chan struct{}, urn string, msgs ...interface{}) (*HubMessage, error) {
+	hubMsg := &HubMessage{ctx: ctx, client: urn, msgs: msgs, status: make(chan RouteStatus, 1)}
+
+	select {
+	case h.receive <- hubMsg:
+		return hubMsg, nil
+	case <-timeout:
+		return nil, ErrHubOverloaded
+	}
+}
+
+// wait waits for the hub to route this message, returning what happened to it. The message is already queued
+// so if the hub doesn't route it in time it is still routed later, and RouteUnconfirmed is returned.
+func (m *HubMessage) wait(timeout <-chan struct{}) RouteStatus {
+	select {
+	case status := <-m.status:
+		return status
+	case <-timeout:
+		return RouteUnconfirmed
 	}
 }
 
 func (h *Hub) Run() {
+	expireTicker := time.NewTicker(10 * time.Second)
+	defer expireTicker.Stop()
+	presenceTicker := time.NewTicker(time.Second)
+	defer presenceTicker.Stop()
+	go h.postPresenceChanges()
+
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client.UserUrn] = client
+			h.sessions.update(client)
+			h.notifyPresence(h.presence.connect(client, time.Now()))
 		case client := <-h.unregister:
-			if _, ok := h.clients[client.UserUrn]; ok {
+			// a client which resumed our session may have taken our place already
+			if h.clients[client.UserUrn] == client {
 				delete(h.clients, client.UserUrn)
-				close(client.send)
+				h.presence.disconnect(client.UserUrn, time.Now())
+			}
+			if client.agent {
+				h.unregisterAgent(client)
+			}
+			close(client.send)
+			h.sessions.detach(client, h.sessionGracePeriod())
+		case req := <-h.resume:
+			if req.client.UserUrn != "" {
+				h.clients[req.client.UserUrn] = req.client
+				h.notifyPresence(h.presence.connect(req.client, time.Now()))
+			}
+			h.sessions.update(req.client)
+			for _, out := range req.buffered {
+				req.client.sendMessage(out.ctx, out.msg)
 			}
 		case hubMsg := <-h.receive:
-			if client, ok := h.clients[hubMsg.client]; ok {
-				client.send <- hubMsg.msg
+			h.route(hubMsg)
+		case req := <-h.watch:
+			req.result <- h.updateWatch(req)
+		case m := <-h.mirror:
+			h.sendToWatchers(m.ctx, m.urn, m.event)
+		case <-expireTicker.C:
+			h.sessions.expire()
+			h.registrations.expire()
+		case <-presenceTicker.C:
+			h.sweepPresence()
+		}
+	}
+}
+
+// route sends the passed in message to the client subscribed to its URN, buffering it if that client is
+// disconnected but can still resume its session
+func (h *Hub) route(hubMsg *HubMessage) {
+	_, span := tracer.Start(hubMsg.ctx, "webchat.hub.route")
+	defer span.End()
+
+	status := RouteNotConnected
+	client, connected := h.clients[hubMsg.client]
+	if connected {
+		status = RouteDelivered
+	} else {
+		buffered := make([]*outboundMessage, len(hubMsg.msgs))
+		for i, msg := range hubMsg.msgs {
+			buffered[i] = &outboundMessage{ctx: hubMsg.ctx, msg: msg}
+		}
+		if h.sessions.buffer(hubMsg.client, buffered, h.Config().SessionBufferSize) {
+			status = RouteBuffered
+		}
+	}
+	span.SetAttributes(attribute.Int("webchat.route_status", int(status)))
+
+	if hubMsg.status != nil {
+		hubMsg.status <- status
+	}
+	if connected {
+		for _, msg := range hubMsg.msgs {
+			client.sendMessage(hubMsg.ctx, msg)
+		}
+	}
+
+	// agents watching the conversation see what the bot, or another agent, says
+	for _, msg := range hubMsg.msgs {
+		if payload, isPayload := msg.(*newMsgPayload); isPayload && len(h.watchers[hubMsg.client]) > 0 {
+			sender := senderBot
+			if payload.agent != "" {
+				sender = senderAgent
 			}
+			h.sendToWatchers(hubMsg.ctx, hubMsg.client, conversationEvent(hubMsg.client, sender, payload.agent, payload.Text, payload))
 		}
 	}
 }
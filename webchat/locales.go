@@ -0,0 +1,146 @@
+package webchat
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/language"
+
+	"github.com/greatnonprofits-nfp/websocket-go/utils"
+)
+
+// builtinCatalogs are the translations of our own messages we ship with, English being the messages themselves
+//
+//go:embed locales/*.json
+var builtinCatalogs embed.FS
+
+// locales are the languages we support and our translations into them, English text being the key of each
+type locales struct {
+	supported []language.Tag
+	matcher   language.Matcher
+	catalogs  map[language.Tag]map[string]string
+}
+
+// newLocales creates locales supporting the passed in comma separated languages, with our built in catalogs and
+// those in the passed in directory, which take precedence
+func newLocales(languages string, dir string) (*locales, error) {
+	l := &locales{catalogs: make(map[language.Tag]map[string]string)}
+	for _, code := range utils.SplitList(languages) {
+		tag, err := language.Parse(code)
+		if err != nil {
+			return nil, fmt.Errorf("invalid language %s: %w", code, err)
+		}
+		l.supported = append(l.supported, tag)
+	}
+	if len(l.supported) == 0 {
+		l.supported = []language.Tag{language.English}
+	}
+	l.matcher = language.NewMatcher(l.supported)
+
+	builtin, _ := builtinCatalogs.ReadDir("locales")
+	for _, entry := range builtin {
+		data, _ := builtinCatalogs.ReadFile("locales/" + entry.Name())
+		if err := l.addCatalog(entry.Name(), data); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if err := l.addCatalog(filepath.Base(file), data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return l, nil
+}
+
+// addCatalog adds the translations in the passed in catalog file, named after its language, to ours
+func (l *locales) addCatalog(name string, data []byte) error {
+	tag, err := language.Parse(strings.TrimSuffix(name, filepath.Ext(name)))
+	if err != nil {
+		return fmt.Errorf("catalog %s isn't named after a language: %w", name, err)
+	}
+
+	translations := make(map[string]string)
+	if err := json.Unmarshal(data, &translations); err != nil {
+		return fmt.Errorf("error parsing catalog %s: %w", name, err)
+	}
+
+	if l.catalogs[tag] == nil {
+		l.catalogs[tag] = make(map[string]string)
+	}
+	for text, translation := range translations {
+		l.catalogs[tag][text] = translation
+	}
+	return nil
+}
+
+// negotiate returns which of our supported languages best matches the passed in preferences, each either a
+// language code or an Accept-Language header, earlier ones being preferred over later ones
+func (l *locales) negotiate(preferences ...string) language.Tag {
+	desired := make([]language.Tag, 0)
+	for _, preference := range preferences {
+		tags, _, err := language.ParseAcceptLanguage(preference)
+		if err == nil {
+			desired = append(desired, tags...)
+		}
+	}
+
+	_, index, confidence := l.matcher.Match(desired...)
+	if confidence == language.No {
+		return l.supported[0]
+	}
+	return l.supported[index]
+}
+
+// translate returns the passed in text in the passed in language, falling back to more general forms of the
+// language and then to the text itself
+func (l *locales) translate(tag language.Tag, text string) string {
+	for t := tag; ; t = t.Parent() {
+		if translation, found := l.catalogs[t][text]; found && translation != "" {
+			return translation
+		}
+		if t == language.Und {
+			return text
+		}
+	}
+}
+
+// LoadLocales loads the languages and translation catalogs in our config, keeping the ones we have if they can't
+// be loaded
+func (h *Hub) LoadLocales() error {
+	config := h.Config()
+	l, err := newLocales(config.Languages, config.LocalesDir)
+	if err != nil {
+		return fmt.Errorf("error loading locales: %w", err)
+	}
+	h.locales.Store(l)
+	return nil
+}
+
+// negotiateLanguage returns the language to use with a client of the passed in channel, from the passed in
+// preferences of the client and then the channel's default language
+func (h *Hub) negotiateLanguage(channel *Channel, preferences ...string) language.Tag {
+	if channel != nil && channel.Language != "" {
+		preferences = append(preferences, channel.Language)
+	}
+	return h.locales.Load().(*locales).negotiate(preferences...)
+}
+
+// translate returns the passed in text in the passed in language
+func (h *Hub) translate(tag language.Tag, text string) string {
+	return h.locales.Load().(*locales).translate(tag, text)
+}
@@ -0,0 +1,390 @@
+package webchat
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/chilts/sid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	outboxOpAdd  = "add"
+	outboxOpDone = "done"
+
+	// outboxCompactThreshold is the number of done records after which our log is rewritten with only what is pending
+	outboxCompactThreshold = 1000
+
+	// outboxMaxBackoff caps how many times the retry interval is doubled between attempts
+	outboxMaxBackoff = 6
+
+	// the statuses widgets are told messages they sent have
+	msgStatusPending = "pending"
+	msgStatusSent    = "sent"
+	msgStatusFailed  = "failed"
+)
+
+// outboxRecord is a line of our write-ahead log, either a message added to the outbox or one that is done with
+type outboxRecord struct {
+	Op          string            `json:"op"`
+	ID          string            `json:"id"`
+	ClientID    string            `json:"client_id,omitempty"`
+	ChannelUUID string            `json:"channel_uuid,omitempty"`
+	HostApi     string            `json:"host_api,omitempty"`
+	URN         string            `json:"urn,omitempty"`
+	ContactURN  string            `json:"contact_urn,omitempty"`
+	RequestID   string            `json:"request_id,omitempty"`
+	Body        map[string]string `json:"body,omitempty"`
+	QueuedOn    *time.Time        `json:"queued_on,omitempty"`
+}
+
+// outboxEntry is a message waiting to be sent to courier along with how its retries are going
+type outboxEntry struct {
+	*outboxRecord
+	attempts    int
+	nextAttempt time.Time
+}
+
+// Outbox keeps messages from contacts that couldn't be sent to courier in a write-ahead log and retries them
+// until courier accepts them, letting the contact know once it has. It is safe for concurrent use.
+type Outbox struct {
+	hub    *Hub
+	path   string
+	logger *logrus.Entry
+
+	mutex   sync.Mutex
+	file    *os.File
+	pending []*outboxEntry
+	done    int
+}
+
+// NewOutbox opens or creates the outbox log at the passed in path, picking up any messages still pending in it
+func NewOutbox(hub *Hub, path string) (*Outbox, error) {
+	o := &Outbox{
+		hub:    hub,
+		path:   path,
+		logger: hub.logger.WithField("comp", "outbox"),
+	}
+
+	err := o.replay()
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox %s: %w", path, err)
+	}
+	err = o.compact()
+	if err != nil {
+		return nil, fmt.Errorf("error compacting outbox %s: %w", path, err)
+	}
+	if len(o.pending) > 0 {
+		o.logger.WithField("pending", len(o.pending)).Info("outbox has pending messages")
+	}
+	return o, nil
+}
+
+// replay reads our log, leaving us with the messages which were added but never done
+func (o *Outbox) replay() error {
+	file, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entries := make(map[string]*outboxEntry)
+	order := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		record := &outboxRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			// a crash can leave a partial last line, which was never acknowledged so is safe to skip
+			o.logger.WithError(err).Warn("skipping unreadable outbox record")
+			continue
+		}
+
+		switch record.Op {
+		case outboxOpAdd:
+			entries[record.ID] = &outboxEntry{outboxRecord: record}
+			order = append(order, record.ID)
+		case outboxOpDone:
+			delete(entries, record.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range order {
+		if entry, found := entries[id]; found {
+			o.pending = append(o.pending, entry)
+		}
+	}
+	return nil
+}
+
+// compact rewrites our log with only the messages still pending and opens it for appending
+func (o *Outbox) compact() error {
+	tmpPath := o.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range o.pending {
+		line, err := json.Marshal(entry.outboxRecord)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if o.file != nil {
+		o.file.Close()
+	}
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return err
+	}
+	o.file, err = os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0600)
+	o.done = 0
+	return err
+}
+
+// write durably appends the passed in record to our log, the mutex must be held
+func (o *Outbox) write(record *outboxRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return o.file.Sync()
+}
+
+// Add writes the passed in courier request body from the passed in client to our log to be retried, returning
+// the ID the client is told about the message with
+func (o *Outbox) Add(client *Client, body map[string]string) (string, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := time.Now().UTC()
+	record := &outboxRecord{
+		Op:          outboxOpAdd,
+		ID:          sid.IdBase64(),
+		ClientID:    client.Id,
+		ChannelUUID: client.ChannelUUID,
+		HostApi:     client.HostApi,
+		URN:         client.UserUrn,
+		ContactURN:  client.contactURN,
+		RequestID:   client.RequestID,
+		Body:        body,
+		QueuedOn:    &now,
+	}
+	if err := o.write(record); err != nil {
+		return "", err
+	}
+
+	o.pending = append(o.pending, &outboxEntry{outboxRecord: record, nextAttempt: now.Add(o.retryInterval())})
+	return record.ID, nil
+}
+
+// HasPending returns whether messages from the passed in URN are waiting to be sent, in which case new ones must
+// wait behind them to keep the conversation in order
+func (o *Outbox) HasPending(urn string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, entry := range o.pending {
+		if entry.URN == urn {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending returns the number of messages waiting to be sent
+func (o *Outbox) Pending() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.pending)
+}
+
+func (o *Outbox) retryInterval() time.Duration {
+	return time.Duration(o.hub.Config().OutboxRetryInterval) * time.Second
+}
+
+// Start starts our retry worker, which runs until the passed in stop channel is closed and then makes one last
+// attempt at everything pending before closing our log
+func (o *Outbox) Start(waitGroup *sync.WaitGroup, stop chan bool) {
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		ticker := time.NewTicker(o.retryInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				o.retry(false)
+			case <-stop:
+				o.retry(true)
+				o.close()
+				return
+			}
+		}
+	}()
+}
+
+// retry sends every pending message that is due, or all of them if force is set. Messages from a URN are sent in
+// order so once one fails the rest from that URN wait for the next round.
+func (o *Outbox) retry(force bool) {
+	blocked := make(map[string]bool)
+	due := make([]*outboxEntry, 0)
+	now := time.Now()
+
+	o.mutex.Lock()
+	for _, entry := range o.pending {
+		if blocked[entry.URN] {
+			continue
+		}
+		if force || !entry.nextAttempt.After(now) {
+			due = append(due, entry)
+		} else {
+			blocked[entry.URN] = true
+		}
+	}
+	o.mutex.Unlock()
+
+	for _, entry := range due {
+		if blocked[entry.URN] {
+			continue
+		}
+
+		err := o.send(entry)
+		if err == nil {
+			o.finish(entry, msgStatusSent)
+			continue
+		}
+
+		entry.attempts++
+		log := o.logger.WithField("outbox_id", entry.ID).WithField("urn", entry.URN).WithField("attempts", entry.attempts)
+		maxAttempts := o.hub.Config().OutboxMaxAttempts
+		if !isRetryable(err) || (maxAttempts > 0 && entry.attempts >= maxAttempts) {
+			log.WithError(err).Error("giving up sending message to courier")
+			o.finish(entry, msgStatusFailed)
+			continue
+		}
+
+		log.WithError(err).Warn("failed to send message to courier, will retry")
+		backoff := entry.attempts
+		if backoff > outboxMaxBackoff {
+			backoff = outboxMaxBackoff
+		}
+		o.mutex.Lock()
+		entry.nextAttempt = time.Now().Add(o.retryInterval() * time.Duration(1<<uint(backoff)))
+		o.mutex.Unlock()
+		blocked[entry.URN] = true
+	}
+}
+
+// send makes the courier request of the passed in entry for the client which queued it
+func (o *Outbox) send(entry *outboxEntry) error {
+	client := newDetachedClient(o.hub, entry.ClientID, entry.ChannelUUID, entry.HostApi, entry.URN, entry.RequestID)
+	client.addLogField("comp", "outbox")
+
+	receiveUrl := fmt.Sprintf("%s/c/wch/%s/receive", entry.HostApi, entry.ChannelUUID)
+	req, err := newCourierRequest(context.Background(), client, http.MethodPost, receiveUrl, entry.Body)
+	if err != nil {
+		return err
+	}
+	_, err = callCourier(client, req)
+	if err != nil {
+		return err
+	}
+
+	o.hub.recordHistory(entry.ContactURN, GetHistoryResponseData{Message: entry.Body["text"], Origin: historyOriginUser})
+	return nil
+}
+
+// finish records the passed in entry as done and lets its contact know what happened to it
+func (o *Outbox) finish(entry *outboxEntry, status string) {
+	o.mutex.Lock()
+	for i, e := range o.pending {
+		if e == entry {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			break
+		}
+	}
+	err := o.write(&outboxRecord{Op: outboxOpDone, ID: entry.ID})
+	if err == nil {
+		o.done++
+		if o.done >= outboxCompactThreshold {
+			err = o.compact()
+		}
+	}
+	o.mutex.Unlock()
+
+	if err != nil {
+		o.logger.WithField("outbox_id", entry.ID).WithError(err).Error("error writing to outbox")
+	}
+
+	if entry.URN != "" {
+		_, err = o.hub.Deliver(context.Background(), entry.URN, messageStatusEvent(entry.ID, status))
+		if err != nil {
+			o.logger.WithField("outbox_id", entry.ID).WithError(err).Warn("unable to tell client about message status")
+		}
+	}
+}
+
+// close closes our log
+func (o *Outbox) close() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if len(o.pending) > 0 {
+		o.logger.WithField("pending", len(o.pending)).Warn("outbox closed with pending messages, they will be retried on restart")
+	}
+	o.file.Close()
+}
+
+// isRetryable returns whether the passed in error sending to courier might not happen again, courier rejecting
+// a message as invalid won't change however often we retry it
+func isRetryable(err error) bool {
+	var courierErr *courierError
+	if !errors.As(err, &courierErr) {
+		return false
+	}
+	return courierErr.statusCode == 0 || courierErr.statusCode == http.StatusTooManyRequests || courierErr.statusCode >= 500
+}
+
+// messageStatusEvent returns the event telling a widget what happened to a message it sent
+func messageStatusEvent(id string, status string) map[string]interface{} {
+	return map[string]interface{}{
+		"event": "messageStatus",
+		"data": map[string]interface{}{
+			"id":     id,
+			"status": status,
+		},
+	}
+}
@@ -0,0 +1,180 @@
+package webchat
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// outboxTexts returns the texts of the messages pending in the passed in outbox in order
+func outboxTexts(o *Outbox) []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	texts := make([]string, 0, len(o.pending))
+	for _, entry := range o.pending {
+		texts = append(texts, entry.Body["text"])
+	}
+	return texts
+}
+
+// outboxLines returns the number of records in the outbox log at the passed in path
+func outboxLines(t *testing.T, path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("error opening outbox log: %s", err)
+	}
+	defer file.Close()
+
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		lines++
+	}
+	return lines
+}
+
+func TestOutboxReplay(t *testing.T) {
+	hub := newTestHub(t, nil)
+	path := filepath.Join(t.TempDir(), "outbox.log")
+
+	outbox, err := NewOutbox(hub, path)
+	if err != nil {
+		t.Fatalf("error opening outbox: %s", err)
+	}
+	client := newDetachedClient(hub, "client-1", testChannelA, "http://courier.invalid", "webchat:1234", "")
+	for _, text := range []string{"one", "two", "three"} {
+		if _, err := outbox.Add(client, map[string]string{"text": text}); err != nil {
+			t.Fatalf("error adding to outbox: %s", err)
+		}
+	}
+	outbox.finish(outbox.pending[1], msgStatusSent)
+	outbox.close()
+
+	if lines := outboxLines(t, path); lines != 4 {
+		t.Fatalf("expected 3 adds and a done in log, got %d records", lines)
+	}
+
+	// a crash can leave a partial record at the end of the log, which is skipped
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	file.Write([]byte(`{"op":"add","id":"partial","bo`))
+	file.Close()
+
+	// reopening picks up what is still pending in order, and compacts the log down to just that
+	outbox, err = NewOutbox(hub, path)
+	if err != nil {
+		t.Fatalf("error reopening outbox: %s", err)
+	}
+	defer outbox.close()
+
+	if texts := outboxTexts(outbox); !reflect.DeepEqual(texts, []string{"one", "three"}) {
+		t.Errorf("expected one and three to be pending, got %v", texts)
+	}
+	if !outbox.HasPending("webchat:1234") || outbox.HasPending("webchat:5678") {
+		t.Errorf("expected only the URN the messages were added for to have pending messages")
+	}
+	if lines := outboxLines(t, path); lines != 2 {
+		t.Errorf("expected compacted log to have 2 records, got %d", lines)
+	}
+}
+
+func TestOutboxCompaction(t *testing.T) {
+	hub := newTestHub(t, nil)
+	path := filepath.Join(t.TempDir(), "outbox.log")
+
+	outbox, err := NewOutbox(hub, path)
+	if err != nil {
+		t.Fatalf("error opening outbox: %s", err)
+	}
+	defer outbox.close()
+
+	client := newDetachedClient(hub, "client-1", testChannelA, "http://courier.invalid", "webchat:1234", "")
+	outbox.Add(client, map[string]string{"text": "one"})
+	outbox.Add(client, map[string]string{"text": "two"})
+
+	// pretend we're one done record away from compacting
+	outbox.done = outboxCompactThreshold - 1
+	outbox.finish(outbox.pending[0], msgStatusSent)
+
+	if lines := outboxLines(t, path); lines != 1 || outbox.done != 0 {
+		t.Errorf("expected log compacted to the one pending record, got %d records and %d done", lines, outbox.done)
+	}
+
+	// and the compacted log is still appended to
+	outbox.Add(client, map[string]string{"text": "three"})
+	if lines := outboxLines(t, path); lines != 2 {
+		t.Errorf("expected compacted log to be appended to, got %d records", lines)
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	// courier is down for anything saying "down", and rejects anything saying "invalid"
+	mutex := sync.Mutex{}
+	received := make([]string, 0)
+	down := true
+	courier := newTestCourier(t, map[string]http.HandlerFunc{
+		"/c/wch/" + testChannelA + "/receive": func(w http.ResponseWriter, r *http.Request) {
+			body := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&body)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case body["text"] == "invalid":
+				courierResponse(400, `{"message":"invalid message"}`)(w, r)
+			case down && body["text"] == "down":
+				courierResponse(503, `{"message":"unavailable"}`)(w, r)
+			default:
+				received = append(received, body["text"])
+				courierResponse(200, `{"message":"ok"}`)(w, r)
+			}
+		},
+	})
+
+	hub := newTestHub(t, nil)
+	outbox, err := NewOutbox(hub, filepath.Join(t.TempDir(), "outbox.log"))
+	if err != nil {
+		t.Fatalf("error opening outbox: %s", err)
+	}
+	defer outbox.close()
+
+	bob := newDetachedClient(hub, "client-1", testChannelA, courier.URL, "webchat:bob", "")
+	ann := newDetachedClient(hub, "client-2", testChannelA, courier.URL, "webchat:ann", "")
+	outbox.Add(bob, map[string]string{"text": "down"})
+	outbox.Add(bob, map[string]string{"text": "after down"})
+	outbox.Add(ann, map[string]string{"text": "invalid"})
+	outbox.Add(ann, map[string]string{"text": "after invalid"})
+
+	// bob's second message waits behind his first, ann's invalid message is given up on so her next one is sent
+	outbox.retry(true)
+	if texts := outboxTexts(outbox); !reflect.DeepEqual(texts, []string{"down", "after down"}) {
+		t.Errorf("expected bob's messages to be pending, got %v", texts)
+	}
+	if outbox.pending[0].attempts != 1 {
+		t.Errorf("expected failed attempt to be counted, got %d", outbox.pending[0].attempts)
+	}
+
+	// unforced retries wait until messages are due
+	mutex.Lock()
+	down = false
+	mutex.Unlock()
+	outbox.retry(false)
+	if outbox.Pending() != 2 {
+		t.Errorf("expected messages not yet due to stay pending, got %d", outbox.Pending())
+	}
+
+	// once courier is back they're sent in order
+	outbox.retry(true)
+	if outbox.Pending() != 0 {
+		t.Errorf("expected outbox to be empty, got %v", outboxTexts(outbox))
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(received, []string{"after invalid", "down", "after down"}) {
+		t.Errorf("unexpected messages received by courier: %v", received)
+	}
+}
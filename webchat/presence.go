@@ -0,0 +1,239 @@
+package webchat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/greatnonprofits-nfp/websocket-go/utils"
+)
+
+const (
+	presenceOnline  = "online"
+	presenceIdle    = "idle"
+	presenceOffline = "offline"
+
+	// presenceRetention is how long we remember when a URN which went offline was last seen
+	presenceRetention = 24 * time.Hour
+
+	// presenceHookQueueSize is the number of presence changes which can wait to be posted to our webhook
+	presenceHookQueueSize = 1000
+
+	// presenceWebhookCourier is the webhook setting which posts presence changes to the contact's courier
+	presenceWebhookCourier = "courier"
+)
+
+// presence is the presence state of a URN, and what presence webhooks are posted
+type presence struct {
+	URN         string     `json:"urn"`
+	ChannelUUID string     `json:"channel_uuid,omitempty"`
+	State       string     `json:"state"`
+	LastSeen    *time.Time `json:"last_seen"`
+
+	hostApi        string
+	requestID      string
+	connected      bool
+	disconnectedAt time.Time
+}
+
+// presenceStore holds the presence state of the URNs we have seen, it is safe for concurrent use
+type presenceStore struct {
+	mutex sync.Mutex
+	byURN map[string]*presence
+}
+
+func newPresenceStore() *presenceStore {
+	return &presenceStore{byURN: make(map[string]*presence)}
+}
+
+// connect records the passed in client as connected, returning its new presence if that is a change. A client
+// reconnecting before its URN was considered offline doesn't change anything.
+func (s *presenceStore) connect(client *Client, now time.Time) *presence {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, found := s.byURN[client.UserUrn]
+	if !found {
+		p = &presence{URN: client.UserUrn}
+		s.byURN[client.UserUrn] = p
+	}
+	p.ChannelUUID = client.ChannelUUID
+	p.hostApi = client.HostApi
+	p.requestID = client.RequestID
+	p.connected = true
+	p.LastSeen = &now
+
+	if p.State == presenceOnline {
+		return nil
+	}
+	p.State = presenceOnline
+	changed := *p
+	return &changed
+}
+
+// disconnect records the URN of the passed in client as disconnected, it only goes offline once our sweep finds
+// it hasn't reconnected
+func (s *presenceStore) disconnect(urn string, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if p, found := s.byURN[urn]; found {
+		p.connected = false
+		p.disconnectedAt = now
+		p.LastSeen = &now
+	}
+}
+
+// seen records activity from the passed in URN, returning its new presence if that brought it back from idle
+func (s *presenceStore) seen(urn string, now time.Time) *presence {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, found := s.byURN[urn]
+	if !found || !p.connected {
+		return nil
+	}
+	p.LastSeen = &now
+
+	if p.State != presenceIdle {
+		return nil
+	}
+	p.State = presenceOnline
+	changed := *p
+	return &changed
+}
+
+// sweep moves connected URNs which haven't been active for the passed in idle timeout to idle, and disconnected
+// ones which haven't come back within the passed in debounce to offline, returning the presences which changed
+func (s *presenceStore) sweep(now time.Time, idleTimeout time.Duration, debounce time.Duration) []*presence {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changes := make([]*presence, 0)
+	for urn, p := range s.byURN {
+		switch {
+		case p.connected && p.State == presenceOnline && idleTimeout > 0 && now.Sub(*p.LastSeen) >= idleTimeout:
+			p.State = presenceIdle
+		case !p.connected && p.State != presenceOffline && now.Sub(p.disconnectedAt) >= debounce:
+			p.State = presenceOffline
+		case !p.connected && now.Sub(*p.LastSeen) >= presenceRetention:
+			delete(s.byURN, urn)
+			continue
+		default:
+			continue
+		}
+		changed := *p
+		changes = append(changes, &changed)
+	}
+	return changes
+}
+
+// channelOf returns the UUID of the channel the passed in URN last connected on, or empty if we haven't seen it
+func (s *presenceStore) channelOf(urn string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if p, found := s.byURN[urn]; found {
+		return p.ChannelUUID
+	}
+	return ""
+}
+
+// get returns the presence of the passed in URN, which is offline if we haven't seen it
+func (s *presenceStore) get(urn string) *presence {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if p, found := s.byURN[urn]; found {
+		current := *p
+		return &current
+	}
+	return &presence{URN: urn, State: presenceOffline}
+}
+
+// sweepPresence applies our idle timeout and debounce to presences, notifying about any that changed
+func (h *Hub) sweepPresence() {
+	config := h.Config()
+	idleTimeout := time.Duration(config.PresenceIdleTimeout) * time.Second
+	debounce := time.Duration(config.PresenceDebounce) * time.Second
+	h.notifyPresence(h.presence.sweep(time.Now(), idleTimeout, debounce)...)
+}
+
+// notifyPresence queues the passed in presence changes to be posted to our presence webhook, if we have one
+func (h *Hub) notifyPresence(changes ...*presence) {
+	webhook := h.Config().PresenceWebhookURL
+	for _, p := range changes {
+		if p == nil {
+			continue
+		}
+		h.logger.WithField("comp", "presence").WithField("urn", p.URN).WithField("state", p.State).Debug("presence changed")
+		if webhook == "" {
+			continue
+		}
+
+		select {
+		case h.presenceHooks <- p:
+		default:
+			h.logger.WithField("comp", "presence").WithField("urn", p.URN).Warn("presence webhook queue full, dropping change")
+		}
+	}
+}
+
+// postPresenceChanges posts queued presence changes to our presence webhook one at a time, so they arrive in the
+// order they happened
+func (h *Hub) postPresenceChanges() {
+	for p := range h.presenceHooks {
+		if webhook := h.Config().PresenceWebhookURL; webhook != "" {
+			h.postPresence(webhook, p)
+		}
+	}
+}
+
+// postPresence posts the passed in presence to the passed in webhook
+func (h *Hub) postPresence(webhook string, p *presence) {
+	client := newDetachedClient(h, "", p.ChannelUUID, p.hostApi, p.URN, p.requestID)
+	client.addLogField("comp", "presence")
+	client.addLogField("urn", p.URN)
+
+	url := webhook
+	if webhook == presenceWebhookCourier {
+		if p.hostApi == "" {
+			return
+		}
+		url = fmt.Sprintf("%s/c/wch/%s/presence", p.hostApi, p.ChannelUUID)
+	}
+
+	req, err := newCourierRequest(context.Background(), client, http.MethodPost, url, p)
+	if err != nil {
+		client.Log().WithError(err).Error("error creating presence webhook request")
+		return
+	}
+	if _, err := callCourier(client, req); err != nil {
+		client.Log().WithError(err).Warn("error posting presence webhook")
+	}
+}
+
+// presenceResponse is our response to a presence query
+type presenceResponse struct {
+	Presence []*presence `json:"presence"`
+}
+
+// PresenceQuery handles a query for the presence of the URNs passed as urn query parameters, responding with
+// the state and last seen time of each in the order they were asked for
+func PresenceQuery(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	urns := r.URL.Query()["urn"]
+	if len(urns) == 0 {
+		_ = utils.WriteJSONError(w, http.StatusBadRequest, "at least one urn must be provided", nil)
+		return
+	}
+
+	results := make([]*presence, len(urns))
+	for i, urn := range urns {
+		results[i] = hub.presence.get(urn)
+	}
+	hub.logger.WithField("request_id", middleware.GetReqID(r.Context())).WithField("urns", len(urns)).Debug("presence queried")
+	_ = utils.WriteJSONResponse(w, http.StatusOK, &presenceResponse{Presence: results})
+}
@@ -0,0 +1,26 @@
+package webchat
+
+import "time"
+
+// eventLimiter allows a number of events per window, it is only used from a client's read pump so isn't safe
+// for concurrent use
+type eventLimiter struct {
+	limit       int
+	window      time.Duration
+	windowStart time.Time
+	count       int
+}
+
+func newEventLimiter(limit int, window time.Duration) *eventLimiter {
+	return &eventLimiter{limit: limit, window: window}
+}
+
+// allow records an event at the passed in time, returning whether it is within our limit
+func (l *eventLimiter) allow(now time.Time) bool {
+	if now.Sub(l.windowStart) >= l.window {
+		l.windowStart = now
+		l.count = 0
+	}
+	l.count++
+	return l.count <= l.limit
+}
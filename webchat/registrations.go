@@ -0,0 +1,98 @@
+package webchat
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errRegistrationFailed = errors.New("registration with courier failed")
+
+// registration is a contact courier registered for a visitor, reused until it expires
+type registration struct {
+	contact   RegisterResponseData
+	expiresOn time.Time
+}
+
+// registrationCall is a registration with courier in flight, which other registrations for the same visitor wait on
+type registrationCall struct {
+	done    chan struct{}
+	contact RegisterResponseData
+	err     error
+}
+
+// registrationCache holds the contacts registered for visitors so repeat registrations don't create new
+// contacts, it is safe for concurrent use
+type registrationCache struct {
+	mutex    sync.Mutex
+	entries  map[string]*registration
+	inflight map[string]*registrationCall
+}
+
+func newRegistrationCache() *registrationCache {
+	return &registrationCache{
+		entries:  make(map[string]*registration),
+		inflight: make(map[string]*registrationCall),
+	}
+}
+
+// registrationKey returns the key registrations of the passed in client are cached under, its user token if
+// the widget persisted one and its visitor id otherwise
+func registrationKey(client *Client) string {
+	if client.UserToken != "" {
+		return client.ChannelUUID + ":token:" + client.UserToken
+	}
+	return client.ChannelUUID + ":visitor:" + client.Id
+}
+
+// get returns the contact registered under the passed in key, calling register to register it if it isn't
+// cached. Concurrent calls for the same key share a single registration. The returned bool is whether the
+// contact came from the cache.
+func (c *registrationCache) get(key string, ttl time.Duration, register func() (RegisterResponseData, error)) (RegisterResponseData, bool, error) {
+	if ttl <= 0 {
+		contact, err := register()
+		return contact, false, err
+	}
+
+	c.mutex.Lock()
+	if entry, found := c.entries[key]; found && entry.expiresOn.After(time.Now()) {
+		c.mutex.Unlock()
+		return entry.contact, true, nil
+	}
+	if call, found := c.inflight[key]; found {
+		c.mutex.Unlock()
+		<-call.done
+		return call.contact, true, call.err
+	}
+	call := &registrationCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mutex.Unlock()
+
+	// waiters must be released even if register panics
+	call.err = errRegistrationFailed
+	defer func() {
+		c.mutex.Lock()
+		delete(c.inflight, key)
+		if call.err == nil {
+			c.entries[key] = &registration{contact: call.contact, expiresOn: time.Now().Add(ttl)}
+		}
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.contact, call.err = register()
+	return call.contact, false, call.err
+}
+
+// expire removes every registration that has expired
+func (c *registrationCache) expire() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for key, entry := range c.entries {
+		if !entry.expiresOn.After(now) {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package webchat
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// session is the state of a client which survives it reconnecting within our grace period
+type session struct {
+	token          string
+	clientID       string
+	userURN        string
+	userToken      string
+	contactURN     string
+	outboundFormat string
+	language       string
+
+	// set while no client is attached, along with the messages sent to its URN in the meantime
+	detachedUntil time.Time
+	buffered      []*outboundMessage
+}
+
+// sessionStore holds our sessions, it is safe for concurrent use
+type sessionStore struct {
+	mutex  sync.Mutex
+	byURN  map[string]*session
+	tokens map[string]*session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		byURN:  make(map[string]*session),
+		tokens: make(map[string]*session),
+	}
+}
+
+// newSessionToken returns a new random token for a session
+func newSessionToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// create creates a new session for the passed in client, returning its token
+func (s *sessionStore) create(client *Client) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token := newSessionToken()
+	s.tokens[token] = &session{token: token, clientID: client.Id, userToken: client.UserToken}
+	return token
+}
+
+// resume reattaches the session with the passed in token, returning it and the messages buffered for it. Nil
+// is returned if there is no such session, it has expired or another client is already attached to it.
+func (s *sessionStore) resume(token string) *session {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, found := s.tokens[token]
+	if !found || sess.detachedUntil.IsZero() || sess.detachedUntil.Before(time.Now()) {
+		return nil
+	}
+
+	resumed := *sess
+	sess.detachedUntil = time.Time{}
+	sess.buffered = nil
+	return &resumed
+}
+
+// update records the current state of the passed in client in its session
+func (s *sessionStore) update(client *Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, found := s.tokens[client.sessionToken]
+	if !found {
+		return
+	}
+
+	if sess.userURN != "" && sess.userURN != client.UserUrn {
+		delete(s.byURN, sess.userURN)
+	}
+	sess.userURN = client.UserUrn
+	sess.userToken = client.UserToken
+	sess.outboundFormat = client.OutboundFormat()
+	sess.language = client.Language().String()
+	if sess.userURN != "" {
+		s.byURN[sess.userURN] = sess
+	}
+}
+
+// setContactURN records the URN courier registered the passed in client as in its session
+func (s *sessionStore) setContactURN(client *Client, urn string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if sess, found := s.tokens[client.sessionToken]; found {
+		sess.contactURN = urn
+	}
+}
+
+// discard removes the session with the passed in token, if there is one
+func (s *sessionStore) discard(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if sess, found := s.tokens[token]; found {
+		s.remove(sess)
+	}
+}
+
+// detach marks the session of the passed in client as waiting to be resumed until the grace period is over, it is
+// removed straight away if there is no grace period
+func (s *sessionStore) detach(client *Client, grace time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, found := s.tokens[client.sessionToken]
+	if !found {
+		return
+	}
+	if grace <= 0 {
+		s.remove(sess)
+		return
+	}
+	sess.detachedUntil = time.Now().Add(grace)
+}
+
+// buffer keeps the passed in messages for the detached session of the passed in URN, returning false if there is
+// no such session or its buffer is full
+func (s *sessionStore) buffer(urn string, msgs []*outboundMessage, max int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, found := s.byURN[urn]
+	if !found || sess.detachedUntil.IsZero() || sess.detachedUntil.Before(time.Now()) || len(sess.buffered)+len(msgs) > max {
+		return false
+	}
+	sess.buffered = append(sess.buffered, msgs...)
+	return true
+}
+
+// expire removes every session whose grace period is over
+func (s *sessionStore) expire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for _, sess := range s.tokens {
+		if !sess.detachedUntil.IsZero() && sess.detachedUntil.Before(now) {
+			s.remove(sess)
+		}
+	}
+}
+
+// remove deletes the passed in session, the mutex must be held
+func (s *sessionStore) remove(sess *session) {
+	delete(s.tokens, sess.token)
+	if s.byURN[sess.userURN] == sess {
+		delete(s.byURN, sess.userURN)
+	}
+}
@@ -0,0 +1,138 @@
+package webchat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// sessionCount returns the number of sessions in the passed in store
+func sessionCount(s *sessionStore) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.tokens)
+}
+
+// waitForDetach waits until the session with the passed in token has been detached by its client disconnecting
+func waitForDetach(t *testing.T, s *sessionStore, token string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		s.mutex.Lock()
+		sess := s.tokens[token]
+		detached := sess != nil && !sess.detachedUntil.IsZero()
+		s.mutex.Unlock()
+		if detached {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("session %s was never detached", token)
+}
+
+func TestSessionStore(t *testing.T) {
+	hub := newTestHub(t, nil)
+	store := newSessionStore()
+	client := newDetachedClient(hub, "c1", testChannelUUID, "", "webchat:1234", "")
+	client.sessionToken = store.create(client)
+	store.update(client)
+
+	// sessions with a client attached can't be resumed or buffered for
+	if store.resume(client.sessionToken) != nil {
+		t.Errorf("expected attached session not to be resumable")
+	}
+	if store.buffer("webchat:1234", []*outboundMessage{{}}, 5) {
+		t.Errorf("expected attached session not to buffer messages")
+	}
+
+	store.detach(client, time.Minute)
+	if !store.buffer("webchat:1234", []*outboundMessage{{}, {}}, 3) {
+		t.Errorf("expected detached session to buffer messages")
+	}
+	if store.buffer("webchat:1234", []*outboundMessage{{}, {}}, 3) {
+		t.Errorf("expected detached session not to buffer beyond its limit")
+	}
+
+	sess := store.resume(client.sessionToken)
+	if sess == nil || sess.clientID != "c1" || sess.userURN != "webchat:1234" || len(sess.buffered) != 2 {
+		t.Fatalf("unexpected resumed session: %+v", sess)
+	}
+	if store.resume(client.sessionToken) != nil {
+		t.Errorf("expected session not to be resumable twice")
+	}
+
+	// sessions are removed once their grace period is over
+	store.detach(client, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	store.expire()
+	if store.resume(client.sessionToken) != nil || sessionCount(store) != 0 || len(store.byURN) != 0 {
+		t.Errorf("expected expired session to be removed")
+	}
+
+	// and straight away without a grace period
+	other := newDetachedClient(hub, "c2", testChannelUUID, "", "webchat:5678", "")
+	other.sessionToken = store.create(other)
+	store.detach(other, 0)
+	if sessionCount(store) != 0 {
+		t.Errorf("expected session without grace period to be removed")
+	}
+
+	// discarding unknown tokens does nothing
+	store.discard("")
+	store.discard("unknown")
+}
+
+func TestHandshakeSession(t *testing.T) {
+	hub := newTestHub(t, nil)
+
+	widget := connectWidget(t, hub, testChannelUUID, "")
+	token, _ := widget.handshake(`{}`)["sessionToken"].(string)
+	if token == "" {
+		t.Fatalf("expected handshake to return a session token")
+	}
+
+	// repeat handshakes keep the session they have
+	for i := 0; i < 3; i++ {
+		response := widget.handshake(`{}`)
+		if response["sessionToken"] != token || response["sessionResumed"] != false {
+			t.Errorf("expected repeat handshake to keep session %s, got %v", token, response)
+		}
+	}
+	if sessionCount(hub.sessions) != 1 {
+		t.Errorf("expected 1 session after repeat handshakes, got %d", sessionCount(hub.sessions))
+	}
+
+	// unknown tokens get a new session
+	other := connectWidget(t, hub, testChannelUUID, "")
+	response := other.handshake(`{"sessionToken":"bogus"}`)
+	if response["sessionResumed"] != false || response["sessionToken"] == token || response["sessionToken"] == "" {
+		t.Errorf("expected unknown session token to get a new session, got %v", response)
+	}
+
+	widget.subscribe(hub, "webchat:1234")
+	widget.conn.Close()
+	waitForDetach(t, hub.sessions, token)
+
+	// messages for a detached session are buffered until it is resumed
+	status, err := hub.Deliver(context.Background(), "webchat:1234", &newMsgPayload{ID: "1", Text: "missed", To: "webchat:1234"})
+	if err != nil || status != RouteBuffered {
+		t.Fatalf("expected message to be buffered, got %d %v", status, err)
+	}
+
+	// the new connection's own session is discarded when it resumes the old one
+	before := sessionCount(hub.sessions)
+	resumer := connectWidget(t, hub, testChannelUUID, "")
+	resumer.handshake(`{}`)
+	response = resumer.handshake(`{"sessionToken":"` + token + `","outboundFormat":"event"}`)
+	if response["sessionResumed"] != true || response["sessionToken"] != token {
+		t.Fatalf("expected session %s to be resumed, got %v", token, response)
+	}
+	if sessionCount(hub.sessions) != before {
+		t.Errorf("expected %d sessions after resuming, got %d", before, sessionCount(hub.sessions))
+	}
+
+	event := resumer.read()
+	data, _ := event["data"].(map[string]interface{})
+	if event["event"] != "receivedMessageFromChannel" || data["text"] != "missed" {
+		t.Errorf("expected buffered message after resuming, got %v", event)
+	}
+}
@@ -0,0 +1,42 @@
+package webchat
+
+import "sync/atomic"
+
+// Stats holds counters of notable websocket events, it is safe for concurrent use
+type Stats struct {
+	oversizedMessages  int64
+	binaryMessages     int64
+	invalidMessages    int64
+	invalidDisconnects int64
+	panics             int64
+	rateLimited        int64
+}
+
+// StatsSnapshot is a point in time copy of our Stats
+type StatsSnapshot struct {
+	OversizedMessages  int64
+	BinaryMessages     int64
+	InvalidMessages    int64
+	InvalidDisconnects int64
+	Panics             int64
+	RateLimited        int64
+}
+
+func (s *Stats) incOversized()          { atomic.AddInt64(&s.oversizedMessages, 1) }
+func (s *Stats) incBinary()             { atomic.AddInt64(&s.binaryMessages, 1) }
+func (s *Stats) incInvalid()            { atomic.AddInt64(&s.invalidMessages, 1) }
+func (s *Stats) incInvalidDisconnects() { atomic.AddInt64(&s.invalidDisconnects, 1) }
+func (s *Stats) incPanics()             { atomic.AddInt64(&s.panics, 1) }
+func (s *Stats) incRateLimited()        { atomic.AddInt64(&s.rateLimited, 1) }
+
+// Snapshot returns the current value of all our counters
+func (s *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		OversizedMessages:  atomic.LoadInt64(&s.oversizedMessages),
+		BinaryMessages:     atomic.LoadInt64(&s.binaryMessages),
+		InvalidMessages:    atomic.LoadInt64(&s.invalidMessages),
+		InvalidDisconnects: atomic.LoadInt64(&s.invalidDisconnects),
+		Panics:             atomic.LoadInt64(&s.panics),
+		RateLimited:        atomic.LoadInt64(&s.rateLimited),
+	}
+}
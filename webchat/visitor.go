@@ -0,0 +1,65 @@
+package webchat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// signVisitorID returns the base64 encoded HMAC-SHA256 of the passed in visitor id
+func signVisitorID(secret string, id string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// visitorID returns the visitor id carried by the signed visitor cookie of the passed in request, or an empty
+// string if visitor cookies are disabled or the request has no valid one
+func (h *Hub) visitorID(r *http.Request) string {
+	config := h.Config()
+	if config.VisitorCookie == "" || config.VisitorSecret == "" {
+		return ""
+	}
+
+	cookie, err := r.Cookie(config.VisitorCookie)
+	if err != nil {
+		return ""
+	}
+
+	i := strings.LastIndex(cookie.Value, ".")
+	if i <= 0 {
+		return ""
+	}
+	id, signature := cookie.Value[:i], cookie.Value[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(signVisitorID(config.VisitorSecret, id))) {
+		return ""
+	}
+	return id
+}
+
+// visitorCookie returns the signed visitor cookie for the passed in visitor id, or nil if visitor cookies are
+// disabled. Widgets are usually embedded in other sites so secure requests get a cookie sent cross site.
+func (h *Hub) visitorCookie(r *http.Request, id string) *http.Cookie {
+	config := h.Config()
+	if config.VisitorCookie == "" || config.VisitorSecret == "" {
+		return nil
+	}
+
+	cookie := &http.Cookie{
+		Name:     config.VisitorCookie,
+		Value:    id + "." + signVisitorID(config.VisitorSecret, id),
+		Path:     "/",
+		MaxAge:   config.VisitorCookieMaxAge,
+		Expires:  time.Now().Add(time.Duration(config.VisitorCookieMaxAge) * time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
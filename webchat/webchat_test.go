@@ -0,0 +1,144 @@
+package webchat
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+
+	server "github.com/greatnonprofits-nfp/websocket-go"
+)
+
+// newTestHub starts a hub with our default config, changed by the passed in function if any
+func newTestHub(t *testing.T, configure func(*server.Config)) *Hub {
+	config := server.NewConfig()
+	if configure != nil {
+		configure(config)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	hub := NewHubWithLogger(config, logger)
+	go hub.Run()
+	return hub
+}
+
+// newTestCourier starts a fake courier which answers each path with the passed in handler
+func newTestCourier(t *testing.T, handlers map[string]http.HandlerFunc) *httptest.Server {
+	courier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler, found := handlers[r.URL.Path]; found {
+			handler(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(courier.Close)
+	return courier
+}
+
+// courierResponse returns a handler which responds with the passed in status and body
+func courierResponse(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+// testWidget is a websocket client of our hub standing in for the webchat widget
+type testWidget struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// connectWidget serves websockets for the passed in hub and connects a widget to it, on the passed in channel of
+// the passed in courier
+func connectWidget(t *testing.T, hub *Hub, channelUUID string, courierURL string) *testWidget {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ServeWS(hub, w, r) }))
+	t.Cleanup(srv.Close)
+
+	query := url.Values{"channelUUID": {channelUUID}, "hostApi": {courierURL}, "userToken": {"token-1"}}
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/socketcluster?" + query.Encode()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("error connecting widget: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testWidget{t: t, conn: conn}
+}
+
+// send sends the passed in event with the passed in JSON data
+func (w *testWidget) send(cid int, event string, data string) {
+	w.t.Helper()
+	msg, _ := json.Marshal(map[string]interface{}{"cid": cid, "event": event, "data": json.RawMessage(data)})
+	if err := w.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		w.t.Fatalf("error sending %s: %s", event, err)
+	}
+}
+
+// read reads the next event sent to the widget, skipping SocketCluster pings
+func (w *testWidget) read() map[string]interface{} {
+	w.t.Helper()
+	for {
+		_ = w.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := w.conn.ReadMessage()
+		if err != nil {
+			w.t.Fatalf("error reading from websocket: %s", err)
+		}
+		if string(data) == "#1" {
+			continue
+		}
+
+		event := make(map[string]interface{})
+		if err := json.Unmarshal(data, &event); err != nil {
+			w.t.Fatalf("widget was sent invalid JSON %s: %s", data, err)
+		}
+		return event
+	}
+}
+
+// handshake sends a handshake with the passed in data and returns the data of its response
+func (w *testWidget) handshake(data string) map[string]interface{} {
+	w.t.Helper()
+	w.send(1, "#handshake", data)
+	response := w.read()
+	result, _ := response["data"].(map[string]interface{})
+	if result == nil {
+		w.t.Fatalf("expected handshake response, got %v", response)
+	}
+	return result
+}
+
+// subscribe subscribes the widget to the passed in URN, waiting until the hub has registered it
+func (w *testWidget) subscribe(hub *Hub, urn string) {
+	w.t.Helper()
+	w.send(2, "#subscribe", `{"channel":"`+urn+`"}`)
+	for i := 0; i < 100; i++ {
+		if status, _ := hub.Deliver(context.Background(), urn); status == RouteDelivered {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.t.Fatalf("widget never subscribed to %s", urn)
+}
+
+// replyError returns the error of the passed in reply, failing if it isn't an error reply to the passed in cid
+func replyError(t *testing.T, reply map[string]interface{}, cid int) map[string]interface{} {
+	t.Helper()
+	if rid, _ := reply["rid"].(float64); int(rid) != cid {
+		t.Fatalf("expected reply to %d, got %v", cid, reply)
+	}
+	errObj, _ := reply["error"].(map[string]interface{})
+	if errObj == nil {
+		t.Fatalf("expected error reply to %d, got %v", cid, reply)
+	}
+	return errObj
+}
@@ -0,0 +1,73 @@
+package webchat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/chilts/sid"
+)
+
+// ChannelTrigger is what is sent to courier on behalf of a new visitor to start a flow for them
+type ChannelTrigger struct {
+	Text  string `json:"text"`
+	Event string `json:"event"`
+}
+
+// hasGreeting returns whether this channel has a welcome message or trigger for new contacts
+func (c *Channel) hasGreeting() bool {
+	return c != nil && (c.WelcomeMessage != "" || (c.Trigger != nil && (c.Trigger.Text != "" || c.Trigger.Event != "")))
+}
+
+// startConversation greets a newly registered contact of the passed in client and sends its channel's trigger
+// to courier, if the channel has either
+func startConversation(ctx context.Context, client *Client, contact RegisterResponseData) {
+	channel := client.channel
+	if !channel.hasGreeting() {
+		return
+	}
+
+	// the greeting is ours so is shown straight away while courier starts the flow
+	if channel.WelcomeMessage != "" {
+		client.sendMessage(ctx, &newMsgPayload{
+			ID:   "welcome-" + sid.IdBase64(),
+			Text: client.translate(channel.WelcomeMessage),
+			To:   contact.ContactUrn,
+		})
+	}
+
+	if channel.Trigger == nil || (channel.Trigger.Text == "" && channel.Trigger.Event == "") {
+		return
+	}
+	body := map[string]string{
+		"from":           contact.ContactUrn,
+		"text":           channel.Trigger.Text,
+		"attachment_url": "",
+	}
+	if channel.Trigger.Event != "" {
+		body["event"] = channel.Trigger.Event
+	}
+
+	err := sendTrigger(ctx, client, body)
+	if err == nil {
+		return
+	}
+	if outbox := client.hub.outbox; outbox != nil && client.featureEnabled(FeatureOutbox) && isRetryable(err) {
+		if _, err := outbox.Add(client, body); err == nil {
+			client.Log().Warnln("Failed to send trigger to courier, queued it for retry")
+			return
+		}
+	}
+	client.Log().Errorln("Failed to send trigger to courier:", err)
+}
+
+// sendTrigger posts the passed in trigger body to courier's receive endpoint
+func sendTrigger(ctx context.Context, client *Client, body map[string]string) error {
+	receiveUrl := fmt.Sprintf("%s/c/wch/%s/receive", client.HostApi, client.ChannelUUID)
+	req, err := newCourierRequest(ctx, client, http.MethodPost, receiveUrl, body)
+	if err != nil {
+		return err
+	}
+	_, err = callCourier(client, req)
+	return err
+}